@@ -7,6 +7,7 @@ replace (
 )
 
 require (
+	github.com/docker/distribution v2.8.1+incompatible
 	github.com/gofiber/fiber/v2 v2.25.0
 	github.com/rs/zerolog v1.26.1
 	k8s.io/api v0.23.3
@@ -22,6 +23,7 @@ require (
 	github.com/klauspost/compress v1.13.4 // indirect
 	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
 	github.com/modern-go/reflect2 v1.0.2 // indirect
+	github.com/opencontainers/go-digest v1.0.0 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
 	github.com/valyala/fasthttp v1.32.0 // indirect
 	github.com/valyala/tcplisten v1.0.0 // indirect
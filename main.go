@@ -1,27 +1,71 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"fmt"
+	"io"
+	"net"
 	"os"
 	"os/signal"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/docker/distribution/reference"
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/recover"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
 	"github.com/rs/zerolog"
 )
 
+// Build information, set at build time with
+// -ldflags "-X main.version=<version> -X main.commit=<commit> -X main.buildDate=<date>".
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
 type AppOptions struct {
-	SidecarImage string
-	DebugMode    bool
+	SidecarImage  string
+	DebugMode     bool
+	Verbosity     int
+	LogFormat     string
+	ListenAddress string
+	HealthPort    uint
+	FailurePolicy string
+	Version       bool
 }
 
 const (
-	fiberAppName string = "PIA Mutating Webhook"
+	fiberAppName         string        = "PIA Mutating Webhook"
+	logFormatJSON        string        = "json"
+	logFormatConsole     string        = "console"
+	defaultVerbosity     int           = 1
+	defaultListenAddress string        = ":8080"
+	defaultHealthPort    uint          = 8081
+	heartbeatInterval    time.Duration = 5 * time.Second
+	requestIDKey         string        = "requestid"
+	loggerKey            string        = "logger"
+	panickedKey          string        = "panicked"
+	failurePolicyOpen    string        = "open"
+	failurePolicyClosed  string        = "closed"
 )
 
 const (
 	CodeNoError int = iota
 	CodeNoSidecarImage
+	CodeInvalidLogFormat
+	CodeInvalidVerbosity
+	CodeInvalidListenAddress
+	CodeInvalidHealthPort
+	CodeInvalidSidecarImage
+	CodeInvalidFailurePolicy
+	CodeCannotListen
+	CodeServeFailed
 )
 
 func main() {
@@ -30,15 +74,39 @@ func main() {
 	flag.StringVar(&opts.SidecarImage, "sidecar-image", "",
 		"Image to inject as a sidecar")
 	flag.BoolVar(&opts.DebugMode, "debug", false,
-		"Whether to show debug log lines")
+		"Whether to show debug log lines. Same as --verbosity=0.")
+	flag.IntVar(&opts.Verbosity, "verbosity", defaultVerbosity,
+		"The log verbosity level, from 0 (verbose) to 3 (silent).")
+	flag.StringVar(&opts.LogFormat, "log-format", logFormatJSON,
+		"The format of the log lines. Accepted values: json or console.")
+	// TODO: use :8443 as default once TLS is supported.
+	flag.StringVar(&opts.ListenAddress, "listen-address", defaultListenAddress,
+		"The address the server listens on, in the host:port format.")
+	flag.UintVar(&opts.HealthPort, "health-port", defaultHealthPort,
+		"The port where the health endpoints are served, without TLS.")
+	flag.StringVar(&opts.FailurePolicy, "failure-policy", failurePolicyClosed,
+		fmt.Sprintf("Whether to admit (%s) or reject (%s) objects when the webhook fails with an internal error. It should match the failurePolicy of the MutatingWebhookConfiguration.", failurePolicyOpen, failurePolicyClosed))
+	flag.BoolVar(&opts.Version, "version", false,
+		"Print the version, commit and build date, then exit.")
 	flag.Parse()
 
+	if opts.Version {
+		fmt.Printf("%s (commit %s, built %s)\n", version, commit, buildDate)
+		os.Exit(CodeNoError)
+	}
+
 	os.Exit(run(opts))
 }
 
 func run(opts *AppOptions) int {
-	log := zerolog.New(os.Stderr).Level(zerolog.InfoLevel)
-	log.Info().Msg("starting...")
+	var logOutput io.Writer = os.Stderr
+	if strings.EqualFold(opts.LogFormat, logFormatConsole) {
+		logOutput = zerolog.ConsoleWriter{Out: os.Stderr}
+	}
+
+	log := zerolog.New(logOutput).Level(zerolog.InfoLevel)
+	log.Info().Str("version", version).Str("commit", commit).
+		Str("build-date", buildDate).Msg("starting...")
 
 	// -----------------------------
 	// Parse options
@@ -49,8 +117,82 @@ func run(opts *AppOptions) int {
 		return CodeNoSidecarImage
 	}
 
+	sidecar := sidecarInfo{}
+	{
+		image, err := reference.ParseNormalizedNamed(opts.SidecarImage)
+		if err != nil {
+			log.Err(err).Str("sidecar-image", opts.SidecarImage).
+				Msg("invalid sidecar image provided")
+			return CodeInvalidSidecarImage
+		}
+
+		sidecar.Image = image.String()
+		sidecar.Registry = reference.Domain(image)
+		sidecar.Repository = reference.Path(image)
+		if tagged, ok := image.(reference.Tagged); ok {
+			sidecar.Tag = tagged.Tag()
+		}
+		if digested, ok := image.(reference.Digested); ok {
+			sidecar.Digest = digested.Digest().String()
+		}
+
+		l := log.Info().Str("registry", sidecar.Registry).
+			Str("repository", sidecar.Repository)
+		if sidecar.Tag != "" {
+			l.Str("tag", sidecar.Tag)
+		}
+		if sidecar.Digest != "" {
+			l.Str("digest", sidecar.Digest)
+		}
+		l.Msg("using sidecar image")
+	}
+
+	if !strings.EqualFold(opts.LogFormat, logFormatJSON) &&
+		!strings.EqualFold(opts.LogFormat, logFormatConsole) {
+		log.Error().Str("log-format", opts.LogFormat).Msg("unknown log format")
+		return CodeInvalidLogFormat
+	}
+
 	if opts.DebugMode {
-		log = log.Level(zerolog.DebugLevel)
+		opts.Verbosity = 0
+	}
+
+	{
+		logLevels := []zerolog.Level{
+			zerolog.DebugLevel,
+			zerolog.InfoLevel,
+			zerolog.ErrorLevel,
+			zerolog.FatalLevel,
+		}
+		if opts.Verbosity < 0 || opts.Verbosity > len(logLevels)-1 {
+			log.Error().Int("verbosity", opts.Verbosity).Msg("invalid verbosity level")
+			return CodeInvalidVerbosity
+		}
+		log = log.Level(logLevels[opts.Verbosity])
+	}
+
+	if _, port, err := net.SplitHostPort(opts.ListenAddress); err != nil {
+		log.Err(err).Str("listen-address", opts.ListenAddress).
+			Msg("invalid listen address provided")
+		return CodeInvalidListenAddress
+	} else if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		log.Err(err).Str("listen-address", opts.ListenAddress).
+			Msg("invalid port provided")
+		return CodeInvalidListenAddress
+	}
+
+	if !strings.EqualFold(opts.FailurePolicy, failurePolicyOpen) &&
+		!strings.EqualFold(opts.FailurePolicy, failurePolicyClosed) {
+		log.Error().Str("failure-policy", opts.FailurePolicy).
+			Msg("unknown failure policy")
+		return CodeInvalidFailurePolicy
+	}
+	failOpen := strings.EqualFold(opts.FailurePolicy, failurePolicyOpen)
+
+	if opts.HealthPort == 0 || opts.HealthPort > 65535 {
+		log.Error().Uint("health-port", opts.HealthPort).
+			Msg("invalid health port provided")
+		return CodeInvalidHealthPort
 	}
 
 	// -----------------------------
@@ -61,15 +203,113 @@ func run(opts *AppOptions) int {
 		AppName:               fiberAppName,
 		ReadTimeout:           time.Minute,
 		DisableStartupMessage: opts.DebugMode,
+		ErrorHandler: func(c *fiber.Ctx, err error) error {
+			if panicked, _ := c.Locals(panickedKey).(bool); panicked {
+				return sendAdmissionFailure(c, failOpen)
+			}
+
+			return fiber.DefaultErrorHandler(c, err)
+		},
+	})
+
+	// Every request gets an ID, taken from the X-Request-ID header if set,
+	// which is sent back and added to all the log lines of the request.
+	app.Use(requestid.New(requestid.Config{ContextKey: requestIDKey}))
+	app.Use(func(c *fiber.Ctx) error {
+		reqID, _ := c.Locals(requestIDKey).(string)
+		c.Locals(loggerKey, clientLogger(c, log.With().Str("request-id", reqID)).Logger())
+
+		l := requestLogger(c)
+		l.Debug().Str("method", c.Method()).Str("path", c.Path()).
+			Msg("request received")
+		return c.Next()
+	})
+
+	// A panic must not take down the webhook, as that would block the
+	// admission of objects in the whole cluster.
+	app.Use(recover.New(recover.Config{
+		EnableStackTrace: true,
+		StackTraceHandler: func(c *fiber.Ctx, e interface{}) {
+			l := requestLogger(c)
+			l.Error().Str("panic", fmt.Sprint(e)).Bytes("stack", debug.Stack()).
+				Str("failure-policy", opts.FailurePolicy).Msg("recovered from panic")
+			c.Locals(panickedKey, true)
+		},
+	}))
+
+	// What would be injected can be inspected when debugging.
+	if opts.DebugMode {
+		app.Get("/debug/sidecar", func(c *fiber.Ctx) error {
+			return c.JSON(sidecar)
+		})
+	}
+
+	// Health endpoints are served on a separate plain HTTP server, so that
+	// the kubelet can probe them even when the webhook uses TLS.
+	healthApp := fiber.New(fiber.Config{
+		AppName:               fiberAppName,
+		ReadTimeout:           time.Minute,
+		DisableStartupMessage: true,
+	})
+
+	// ready is set to 1 once everything is set up and the webhook can
+	// serve requests, and back to 0 when shutting down.
+	var ready int32
+
+	// lastHeartbeat is updated by the main loop: if it stops doing so, the
+	// process is considered stuck.
+	lastHeartbeat := time.Now().UnixNano()
+
+	healthApp.Get("/readyz", func(c *fiber.Ctx) error {
+		if atomic.LoadInt32(&ready) == 0 {
+			return c.SendStatus(fiber.StatusServiceUnavailable)
+		}
+
+		return c.SendStatus(fiber.StatusOK)
 	})
 
-	app.Get("/readyz", func(c *fiber.Ctx) error {
+	healthApp.Get("/healthz", func(c *fiber.Ctx) error {
+		beat := time.Unix(0, atomic.LoadInt64(&lastHeartbeat))
+		if time.Since(beat) > 3*heartbeatInterval {
+			return c.SendStatus(fiber.StatusServiceUnavailable)
+		}
+
 		return c.SendStatus(fiber.StatusOK)
 	})
 
+	// Addresses are bound before serving, so that the webhook is only
+	// reported as ready once it can actually accept connections.
+	listener, err := net.Listen("tcp", opts.ListenAddress)
+	if err != nil {
+		log.Err(err).Str("listen-address", opts.ListenAddress).
+			Msg("could not listen on address")
+		return CodeCannotListen
+	}
+
+	healthAddress := fmt.Sprintf(":%d", opts.HealthPort)
+	healthListener, err := net.Listen("tcp", healthAddress)
+	if err != nil {
+		listener.Close()
+		log.Err(err).Str("health-address", healthAddress).
+			Msg("could not listen on address")
+		return CodeCannotListen
+	}
+
+	// If any of the servers stops, the webhook exits so that it is
+	// restarted, rather than looking healthy while serving nothing.
+	serveErr := make(chan error, 2)
+
+	go func() {
+		log.Info().Str("listen-address", opts.ListenAddress).Msg("listening...")
+		if err := app.Listener(listener); err != nil {
+			serveErr <- fmt.Errorf("server stopped: %w", err)
+		}
+	}()
+
 	go func() {
-		if err := app.Listen(":8080"); err != nil {
-			log.Err(err).Msg("error while starting server")
+		log.Info().Str("health-address", healthAddress).Msg("serving health endpoints...")
+		if err := healthApp.Listener(healthListener); err != nil {
+			serveErr <- fmt.Errorf("health server stopped: %w", err)
 		}
 	}()
 
@@ -79,13 +319,121 @@ func run(opts *AppOptions) int {
 
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt)
-	<-stop
 
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	exitCode := CodeNoError
+	atomic.StoreInt32(&ready, 1)
+	for stopping := false; !stopping; {
+		select {
+		case <-heartbeat.C:
+			atomic.StoreInt64(&lastHeartbeat, time.Now().UnixNano())
+		case err := <-serveErr:
+			log.Err(err).Msg("error while serving")
+			exitCode = CodeServeFailed
+			stopping = true
+		case <-stop:
+			stopping = true
+		}
+	}
+
+	atomic.StoreInt32(&ready, 0)
 	log.Info().Msg("shutting down...")
 	if err := app.Shutdown(); err != nil {
 		log.Err(err).Msg("error while waiting for server to shutdown")
 	}
+	if err := healthApp.Shutdown(); err != nil {
+		log.Err(err).Msg("error while waiting for health server to shutdown")
+	}
 	log.Info().Msg("goodbye!")
 
-	return CodeNoError
+	return exitCode
+}
+
+// requestLogger returns the logger of the request in c, which includes its
+// request ID.
+func requestLogger(c *fiber.Ctx) zerolog.Logger {
+	if l, ok := c.Locals(loggerKey).(zerolog.Logger); ok {
+		return l
+	}
+
+	return zerolog.Nop()
+}
+
+// clientLogger adds to l what is known about the client of c, which helps
+// telling apart the API server replicas calling the webhook.
+func clientLogger(c *fiber.Ctx, l zerolog.Context) zerolog.Context {
+	l = l.Str("remote-ip", c.IP()).Str("user-agent", c.Get(fiber.HeaderUserAgent))
+	if forwardedFor := c.Get(fiber.HeaderXForwardedFor); forwardedFor != "" {
+		l = l.Str("forwarded-for", forwardedFor)
+	}
+	if realIP := c.Get("X-Real-Ip"); realIP != "" {
+		l = l.Str("real-ip", realIP)
+	}
+
+	// The API server only presents a certificate when the webhook is served
+	// with TLS and asks for one.
+	if state := c.Context().TLSConnectionState(); state != nil && len(state.PeerCertificates) > 0 {
+		l = l.Str("peer-cn", state.PeerCertificates[0].Subject.CommonName)
+	}
+
+	return l
+}
+
+// sidecarInfo describes the sidecar that is injected.
+type sidecarInfo struct {
+	Image      string `json:"image"`
+	Registry   string `json:"registry"`
+	Repository string `json:"repository"`
+	Tag        string `json:"tag,omitempty"`
+	Digest     string `json:"digest,omitempty"`
+}
+
+// admissionReview only contains the fields of an AdmissionReview that are
+// needed to answer one.
+type admissionReview struct {
+	APIVersion string             `json:"apiVersion"`
+	Kind       string             `json:"kind"`
+	Request    *admissionRequest  `json:"request,omitempty"`
+	Response   *admissionResponse `json:"response,omitempty"`
+}
+
+type admissionRequest struct {
+	UID string `json:"uid"`
+}
+
+type admissionResponse struct {
+	UID     string           `json:"uid"`
+	Allowed bool             `json:"allowed"`
+	Status  *admissionStatus `json:"status,omitempty"`
+}
+
+type admissionStatus struct {
+	Message string `json:"message"`
+}
+
+// sendAdmissionFailure answers the AdmissionReview in the body of c after an
+// internal error, allowing the object if failOpen is true.
+func sendAdmissionFailure(c *fiber.Ctx, failOpen bool) error {
+	review := admissionReview{}
+	_ = json.Unmarshal(c.Body(), &review)
+
+	resp := admissionReview{
+		APIVersion: review.APIVersion,
+		Kind:       review.Kind,
+		Response: &admissionResponse{
+			Allowed: failOpen,
+			Status:  &admissionStatus{Message: "internal error"},
+		},
+	}
+	if review.Request != nil {
+		resp.Response.UID = review.Request.UID
+	}
+	if resp.APIVersion == "" {
+		resp.APIVersion = "admission.k8s.io/v1"
+		resp.Kind = "AdmissionReview"
+	}
+
+	return c.Status(fiber.StatusOK).JSON(resp)
 }
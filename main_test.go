@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestRunCannotListen(t *testing.T) {
+	// Whatever is already listening, run must exit instead of looking
+	// healthy while serving nothing.
+	taken, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer taken.Close()
+	takenPort := taken.Addr().(*net.TCPAddr).Port
+
+	free, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	freePort := free.Addr().(*net.TCPAddr).Port
+	free.Close()
+
+	tests := []struct {
+		name          string
+		listenAddress string
+		healthPort    int
+	}{
+		{name: "webhook", listenAddress: taken.Addr().String(), healthPort: freePort},
+		{name: "health", listenAddress: "127.0.0.1:0", healthPort: takenPort},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := &AppOptions{
+				SidecarImage:  "example.com/pia-sidecar:latest",
+				Verbosity:     1,
+				LogFormat:     logFormatJSON,
+				ListenAddress: tt.listenAddress,
+				HealthPort:    uint(tt.healthPort),
+				FailurePolicy: failurePolicyOpen,
+			}
+
+			if code := run(opts); code != CodeCannotListen {
+				t.Errorf("got exit code %d, want %d", code, CodeCannotListen)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// cache holds the results of the last cycle, so that they can be written
+// right after a restart, without waiting for the first cycle to complete.
+type cache struct {
+	Results   []*ServerLatency `json:"results"`
+	RegionIDs map[string]bool  `json:"regionIDs"`
+	Stats     cycleStats       `json:"stats"`
+}
+
+// saveCache writes c to path. The file is replaced atomically, so that a
+// crash while writing it does not leave a truncated cache behind.
+func saveCache(path string, c *cache) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// loadCache reads the cache at path. It returns nil if the file does not
+// exist.
+func loadCache(path string) (*cache, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	c := &cache{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
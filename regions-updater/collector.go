@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// collector gathers the results of the servers dispatched in an update
+// cycle. Cycles are numbered and so are the servers dispatched in them, so
+// that results arriving after their cycle ended, i.e. because it timed out,
+// are dropped instead of leaking into the next one.
+//
+// Latencies are smoothed as they come in, and servers whose smoothed
+// latency is greater than maxLatency are marked as degraded.
+type collector struct {
+	keepDegraded bool
+	maxLatency   time.Duration
+	alpha        float64
+
+	// averages are the smoothed latencies of the last cycle, by server IP,
+	// and next the ones of the current cycle.
+	averages map[string]Duration
+	next     map[string]Duration
+
+	cycle   uint64
+	cycling bool
+	// cancel stops what is left of the current cycle, i.e. the dispatch of
+	// its servers, once it ends.
+	cancel context.CancelFunc
+	// dispatched is the number of servers dispatched in the current cycle,
+	// or -1 until the dispatch is complete.
+	dispatched int
+	probed     int
+	measured   int
+	degraded   int
+	regions    map[string]bool
+	results    []*ServerLatency
+}
+
+func newCollector(keepDegraded bool, maxLatency time.Duration, alpha float64) *collector {
+	return &collector{
+		keepDegraded: keepDegraded,
+		maxLatency:   maxLatency,
+		alpha:        alpha,
+		averages:     map[string]Duration{},
+		next:         map[string]Duration{},
+		dispatched:   -1,
+		regions:      map[string]bool{},
+		results:      []*ServerLatency{},
+	}
+}
+
+// start begins a new cycle and returns its number, to be set on the
+// servers dispatched in it. cancel is called when the cycle ends.
+func (c *collector) start(cancel context.CancelFunc) uint64 {
+	c.cycle++
+	c.cycling = true
+	c.cancel = cancel
+	c.dispatched, c.probed = -1, 0
+	c.measured, c.degraded = 0, 0
+	c.regions = map[string]bool{}
+	c.results = []*ServerLatency{}
+	c.next = map[string]Duration{}
+
+	return c.cycle
+}
+
+// setDispatched records that count servers were dispatched in cycle. It
+// returns false if cycle is not the current one, and done is true if all of
+// them have already been probed.
+func (c *collector) setDispatched(cycle uint64, count int) (done, ok bool) {
+	if !c.cycling || cycle != c.cycle {
+		return false, false
+	}
+
+	c.dispatched = count
+	return c.probed == c.dispatched, true
+}
+
+// add records the result of a probe, unless it belongs to another cycle.
+// Servers that could not be measured are only kept if keepDegraded is true.
+// It returns true once all the servers dispatched have been probed.
+func (c *collector) add(lat *ServerLatency) bool {
+	if !c.cycling || lat.cycle != c.cycle {
+		return false
+	}
+
+	c.probed++
+	c.regions[lat.Region.ID] = true
+	if lat.Latency != nil {
+		c.smooth(lat)
+		dropSlow(lat, c.maxLatency)
+	}
+
+	switch {
+	case lat.Latency != nil:
+		c.measured++
+	case lat.Degraded:
+		c.degraded++
+	}
+
+	keep := lat.Latency != nil || (c.keepDegraded && lat.Degraded)
+	if keep && len(lat.Servers.WireGuard) > 0 {
+		c.results = append(c.results, lat)
+	}
+
+	return c.probed == c.dispatched
+}
+
+// smooth replaces the latency of lat with its exponentially weighted moving
+// average, computed with the one of the last cycle.
+func (c *collector) smooth(lat *ServerLatency) {
+	if prev, exists := c.averages[lat.IP]; exists {
+		avg := Duration(c.alpha*float64(*lat.Latency) + (1-c.alpha)*float64(prev))
+		lat.Latency = &avg
+	}
+	c.next[lat.IP] = *lat.Latency
+}
+
+// seed sets the smoothed latencies from results, i.e. the ones loaded from
+// the cache, as if they were the ones of the last cycle.
+func (c *collector) seed(results []*ServerLatency) {
+	c.averages = map[string]Duration{}
+	for _, res := range results {
+		if res.Latency != nil {
+			c.averages[res.IP] = *res.Latency
+		}
+	}
+}
+
+// end ends the current cycle and returns its results. Results of the cycle
+// arriving later on are dropped.
+func (c *collector) end() []*ServerLatency {
+	results := c.results
+	c.cycling = false
+	c.dispatched = -1
+	if c.cancel != nil {
+		c.cancel()
+		c.cancel = nil
+	}
+	c.results = []*ServerLatency{}
+
+	// Cycles that could not probe anything, e.g. because the servers list
+	// could not be loaded, don't forget the averages.
+	if c.probed > 0 {
+		c.averages = c.next
+	}
+
+	return results
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func newTestResult(cycle uint64, regionID, ip string, latency time.Duration) *ServerLatency {
+	lat := Duration(latency)
+	return &ServerLatency{
+		Latency: &lat,
+		Server:  &Server{IP: ip},
+		Region: &Region{
+			ID:      regionID,
+			Servers: &ServersList{WireGuard: []*Server{{IP: ip}}},
+		},
+		cycle: cycle,
+	}
+}
+
+func TestCollectorDropsLateResults(t *testing.T) {
+	const (
+		cycles  = 5
+		servers = 10
+	)
+
+	col := newCollector(false, time.Second, 1)
+	var late []*ServerLatency
+	for i := 0; i < cycles; i++ {
+		cycle := col.start(nil)
+		if _, ok := col.setDispatched(cycle, servers); !ok {
+			t.Fatalf("cycle %d: dispatch rejected", cycle)
+		}
+
+		// Results of the previous cycle that timed out come in first.
+		for _, lat := range late {
+			if col.add(lat) {
+				t.Fatalf("cycle %d: late result completed the cycle", cycle)
+			}
+		}
+		if col.probed != 0 || len(col.results) != 0 {
+			t.Fatalf("cycle %d: late results were collected", cycle)
+		}
+
+		// Only half of the servers respond before the timeout, the other
+		// half comes in during the next cycle.
+		late = nil
+		for j := 0; j < servers; j++ {
+			lat := newTestResult(cycle, "r", fmt.Sprintf("10.0.%d.%d", i, j), time.Duration(j)*time.Millisecond)
+			if j%2 == 0 {
+				late = append(late, lat)
+				continue
+			}
+			if col.add(lat) {
+				t.Fatalf("cycle %d: completed with %d results", cycle, col.probed)
+			}
+		}
+
+		results := col.end()
+		if len(results) != servers/2 {
+			t.Fatalf("cycle %d: got %d results, want %d", cycle, len(results), servers/2)
+		}
+		for _, res := range results {
+			if res.cycle != cycle {
+				t.Errorf("cycle %d: got a result of cycle %d", cycle, res.cycle)
+			}
+		}
+		if col.dispatched != -1 {
+			t.Errorf("cycle %d: dispatched is %d after the end of the cycle", cycle, col.dispatched)
+		}
+
+		// Results arriving between cycles are dropped too.
+		if col.add(late[0]) || len(col.results) != 0 {
+			t.Errorf("cycle %d: result collected between cycles", cycle)
+		}
+	}
+}
+
+func TestCollectorCompletesCycle(t *testing.T) {
+	col := newCollector(true, time.Second, 1)
+	cycle := col.start(nil)
+
+	// Results can come in before the dispatch is complete.
+	if col.add(newTestResult(cycle, "r1", "10.0.0.1", time.Millisecond)) {
+		t.Fatal("cycle completed before the dispatch")
+	}
+
+	degraded := newTestResult(cycle, "r2", "10.0.0.2", 0)
+	degraded.Latency, degraded.Degraded = nil, true
+	if col.add(degraded) {
+		t.Fatal("cycle completed before the dispatch")
+	}
+
+	if done, ok := col.setDispatched(cycle-1, 2); done || ok {
+		t.Fatal("dispatch of a previous cycle accepted")
+	}
+	if done, ok := col.setDispatched(cycle, 3); done || !ok {
+		t.Fatalf("got done=%t ok=%t, want done=false ok=true", done, ok)
+	}
+	if !col.add(newTestResult(cycle, "r1", "10.0.0.3", time.Millisecond)) {
+		t.Fatal("cycle not completed once all servers were probed")
+	}
+
+	if col.measured != 2 || col.degraded != 1 || len(col.regions) != 2 {
+		t.Errorf("got measured=%d degraded=%d regions=%d, want 2, 1 and 2",
+			col.measured, col.degraded, len(col.regions))
+	}
+	if results := col.end(); len(results) != 3 {
+		t.Errorf("got %d results, want 3 with degraded servers kept", len(results))
+	}
+}
+
+func TestCollectorDropsSlowAverages(t *testing.T) {
+	col := newCollector(false, 50*time.Millisecond, 0.5)
+
+	cycle := col.start(nil)
+	col.setDispatched(cycle, 1)
+	col.add(newTestResult(cycle, "r", "10.0.0.1", 20*time.Millisecond))
+	col.end()
+
+	// A single spike is averaged out: 0.5*70ms + 0.5*20ms = 45ms.
+	cycle = col.start(nil)
+	col.setDispatched(cycle, 1)
+	col.add(newTestResult(cycle, "r", "10.0.0.1", 70*time.Millisecond))
+	results := col.end()
+	if len(results) != 1 || time.Duration(*results[0].Latency) != 45*time.Millisecond {
+		t.Fatalf("got %v, want a single result of 45ms", results)
+	}
+
+	// A sustained one is not: 0.5*90ms + 0.5*45ms = 67.5ms.
+	cycle = col.start(nil)
+	col.setDispatched(cycle, 1)
+	lat := newTestResult(cycle, "r", "10.0.0.1", 90*time.Millisecond)
+	col.add(lat)
+	if results := col.end(); len(results) != 0 {
+		t.Fatalf("got %d results, want none", len(results))
+	}
+	if lat.Latency != nil || !lat.Degraded {
+		t.Errorf("slow server not marked as degraded")
+	}
+}
+
+func TestCollectorCancelsEndedCycle(t *testing.T) {
+	col := newCollector(false, time.Second, 1)
+
+	ctx, canc := context.WithCancel(context.Background())
+	defer canc()
+	col.start(canc)
+	if ctx.Err() != nil {
+		t.Fatal("cycle canceled before it ended")
+	}
+
+	// The cycle times out before its dispatch completes.
+	col.end()
+	if ctx.Err() == nil {
+		t.Error("cycle not canceled once ended")
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	kerr "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// transientError is implemented by errors that may go away if the same
+// operation is tried again later.
+type transientError interface {
+	IsTransient() bool
+}
+
+// FetchError is returned when the list of servers could not be retrieved.
+type FetchError struct {
+	Err error
+}
+
+func (e *FetchError) Error() string {
+	return fmt.Sprintf("could not fetch servers list: %s", e.Err)
+}
+
+func (e *FetchError) Unwrap() error {
+	return e.Err
+}
+
+// IsTransient returns true if the server list could not be fetched because
+// of a network problem or a server side error, rather than because of a bad
+// request or response.
+func (e *FetchError) IsTransient() bool {
+	return isNetworkError(e.Err) || isTransient(e.Err)
+}
+
+// StatusError is returned when the servers list is served with a status
+// code other than 200 OK. It is usually wrapped in a FetchError.
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status code %d", e.StatusCode)
+}
+
+// IsTransient returns true for server side errors and rate limiting.
+func (e *StatusError) IsTransient() bool {
+	return e.StatusCode >= http.StatusInternalServerError ||
+		e.StatusCode == http.StatusTooManyRequests
+}
+
+// DecodeError is returned when the servers list was retrieved but its
+// contents are not valid.
+type DecodeError struct {
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("could not decode servers list: %s", e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// IsTransient always returns false, as the same list is likely to be served
+// again until it is fixed.
+func (e *DecodeError) IsTransient() bool {
+	return false
+}
+
+// ProbeError is returned when the latency of a server could not be measured.
+type ProbeError struct {
+	Address string
+	Err     error
+}
+
+func (e *ProbeError) Error() string {
+	return fmt.Sprintf("could not probe %s: %s", e.Address, e.Err)
+}
+
+func (e *ProbeError) Unwrap() error {
+	return e.Err
+}
+
+// IsTransient returns true if the server could not be reached in time, as
+// it may answer faster on the next cycle.
+func (e *ProbeError) IsTransient() bool {
+	return isNetworkError(e.Err)
+}
+
+// WriteError is returned when the results could not be written to the
+// configmap.
+type WriteError struct {
+	Err error
+}
+
+func (e *WriteError) Error() string {
+	return fmt.Sprintf("could not write configmap: %s", e.Err)
+}
+
+func (e *WriteError) Unwrap() error {
+	return e.Err
+}
+
+// IsTransient returns true if the API server rejected the write for a
+// reason that is expected to resolve itself, e.g. a conflict or a timeout.
+// Errors like missing permissions or invalid data are permanent.
+func (e *WriteError) IsTransient() bool {
+	return kerr.IsConflict(e.Err) ||
+		kerr.IsServerTimeout(e.Err) ||
+		kerr.IsTimeout(e.Err) ||
+		kerr.IsTooManyRequests(e.Err) ||
+		kerr.IsServiceUnavailable(e.Err) ||
+		kerr.IsInternalError(e.Err) ||
+		isNetworkError(e.Err)
+}
+
+// isTransient returns whether err, or any error it wraps, is transient.
+func isTransient(err error) bool {
+	var terr transientError
+	if errors.As(err, &terr) {
+		return terr.IsTransient()
+	}
+
+	return false
+}
+
+// retryTransient calls fn until it succeeds or returns an error that is not
+// transient, at most attempts times. It waits backoff before the second
+// attempt and twice as long before each of the following ones, and gives up
+// when ctx is done. The last error is returned.
+func retryTransient(ctx context.Context, attempts int, backoff time.Duration, fn func() error) error {
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return err
+			}
+			backoff *= 2
+		}
+
+		if err = fn(); err == nil || !isTransient(err) {
+			return err
+		}
+	}
+
+	return err
+}
+
+// failureCounter counts how many times in a row an operation failed with a
+// permanent error. Transient errors are not counted, as they are expected
+// to go away without restarting, and a success starts again from scratch.
+type failureCounter struct {
+	mu    sync.Mutex
+	limit int
+	count int
+}
+
+// record records the outcome of the operation and returns true once it
+// failed limit times in a row.
+func (f *failureCounter) record(err error) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case err == nil:
+		f.count = 0
+	case errors.Is(err, context.Canceled):
+		// Shutting down.
+	case !isTransient(err):
+		f.count++
+	}
+
+	return f.limit > 0 && f.count >= f.limit
+}
+
+func isNetworkError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var nerr net.Error
+	return errors.As(err, &nerr)
+}
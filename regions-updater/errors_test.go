@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	kerr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestIsTransient(t *testing.T) {
+	configMaps := schema.GroupResource{Resource: "configmaps"}
+	timeout := &net.OpError{Op: "dial", Net: "tcp", Err: context.DeadlineExceeded}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil", err: nil, want: false},
+		{name: "plain", err: errors.New("plain"), want: false},
+
+		{name: "fetch network", err: &FetchError{Err: timeout}, want: true},
+		{name: "fetch deadline", err: &FetchError{Err: context.DeadlineExceeded}, want: true},
+		{name: "fetch server error", err: &FetchError{Err: &StatusError{StatusCode: http.StatusBadGateway}}, want: true},
+		{name: "fetch too many requests", err: &FetchError{Err: &StatusError{StatusCode: http.StatusTooManyRequests}}, want: true},
+		{name: "fetch not found", err: &FetchError{Err: &StatusError{StatusCode: http.StatusNotFound}}, want: false},
+		{name: "fetch forbidden", err: &FetchError{Err: &StatusError{StatusCode: http.StatusForbidden}}, want: false},
+		{name: "fetch decode", err: &FetchError{Err: &DecodeError{Err: errors.New("bad json")}}, want: false},
+
+		{name: "status server error", err: &StatusError{StatusCode: http.StatusInternalServerError}, want: true},
+		{name: "status unauthorized", err: &StatusError{StatusCode: http.StatusUnauthorized}, want: false},
+
+		{name: "decode", err: &DecodeError{Err: errors.New("bad json")}, want: false},
+
+		{name: "probe timeout", err: &ProbeError{Address: "10.0.0.1:1337", Err: timeout}, want: true},
+		{name: "probe refused", err: &ProbeError{Address: "10.0.0.1:1337", Err: errors.New("connection refused")}, want: false},
+
+		{name: "write conflict", err: &WriteError{Err: kerr.NewConflict(configMaps, "pia", errors.New("modified"))}, want: true},
+		{name: "write server timeout", err: &WriteError{Err: kerr.NewServerTimeout(configMaps, "update", 1)}, want: true},
+		{name: "write timeout", err: &WriteError{Err: kerr.NewTimeoutError("timeout", 1)}, want: true},
+		{name: "write too many requests", err: &WriteError{Err: kerr.NewTooManyRequests("slow down", 1)}, want: true},
+		{name: "write unavailable", err: &WriteError{Err: kerr.NewServiceUnavailable("unavailable")}, want: true},
+		{name: "write network", err: &WriteError{Err: timeout}, want: true},
+		{name: "write forbidden", err: &WriteError{Err: kerr.NewForbidden(configMaps, "pia", errors.New("rbac"))}, want: false},
+		{name: "write invalid", err: &WriteError{Err: kerr.NewBadRequest("invalid")}, want: false},
+
+		{name: "wrapped", err: fmt.Errorf("cycle: %w", &WriteError{Err: kerr.NewConflict(configMaps, "pia", errors.New("modified"))}), want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isTransient(tt.err); got != tt.want {
+				t.Errorf("isTransient(%v) = %t, want %t", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryTransient(t *testing.T) {
+	configMaps := schema.GroupResource{Resource: "configmaps"}
+	conflict := &WriteError{Err: kerr.NewConflict(configMaps, "pia", errors.New("modified"))}
+	forbidden := &WriteError{Err: kerr.NewForbidden(configMaps, "pia", errors.New("rbac"))}
+
+	tests := []struct {
+		name      string
+		errs      []error
+		wantCalls int
+		wantErr   error
+	}{
+		{name: "success", errs: []error{nil}, wantCalls: 1},
+		{name: "permanent", errs: []error{forbidden, nil}, wantCalls: 1, wantErr: forbidden},
+		{name: "transient then success", errs: []error{conflict, nil}, wantCalls: 2},
+		{name: "transient then permanent", errs: []error{conflict, forbidden, nil}, wantCalls: 2, wantErr: forbidden},
+		{name: "always transient", errs: []error{conflict, conflict, conflict, nil}, wantCalls: 3, wantErr: conflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := retryTransient(context.Background(), 3, time.Millisecond, func() error {
+				calls++
+				return tt.errs[calls-1]
+			})
+
+			if calls != tt.wantCalls {
+				t.Errorf("got %d calls, want %d", calls, tt.wantCalls)
+			}
+			if err != tt.wantErr {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, canc := context.WithCancel(context.Background())
+		calls := 0
+		err := retryTransient(ctx, 3, time.Hour, func() error {
+			calls++
+			canc()
+			return conflict
+		})
+		if calls != 1 || err != conflict {
+			t.Errorf("got %d calls and error %v, want 1 and %v", calls, err, conflict)
+		}
+	})
+}
+
+func TestFailureCounter(t *testing.T) {
+	configMaps := schema.GroupResource{Resource: "configmaps"}
+	forbidden := &WriteError{Err: kerr.NewForbidden(configMaps, "pia", errors.New("rbac"))}
+	timeout := &FetchError{Err: context.DeadlineExceeded}
+
+	steps := []struct {
+		err  error
+		want bool
+	}{
+		{err: forbidden, want: false},
+		{err: timeout, want: false},
+		{err: context.Canceled, want: false},
+		{err: forbidden, want: false},
+		// A success starts again from scratch.
+		{err: nil, want: false},
+		{err: forbidden, want: false},
+		{err: forbidden, want: false},
+		{err: forbidden, want: true},
+	}
+
+	counter := &failureCounter{limit: 3}
+	for i, step := range steps {
+		if got := counter.record(step.err); got != step.want {
+			t.Fatalf("step %d: got %t after %v, want %t", i, got, step.err, step.want)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	icmpNetwork      string = "ip4:icmp"
+	icmpProtocolIPv4 int    = 1
+	icmpPayload      string = "pia-regions-updater"
+)
+
+// checkICMP returns an error if ICMP echo requests cannot be sent, which is
+// the case when the process does not have the NET_RAW capability.
+func checkICMP() error {
+	conn, err := icmp.ListenPacket(icmpNetwork, "0.0.0.0")
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+// ping sends an ICMP echo request to ip from source, or any address if
+// empty, and returns the time it took to get the reply. It gives up after
+// timeout or when ctx is done.
+func ping(ctx context.Context, source, ip string, timeout time.Duration) (time.Duration, error) {
+	dst := net.ParseIP(ip).To4()
+	if dst == nil {
+		return 0, fmt.Errorf("%s is not an IPv4 address", ip)
+	}
+
+	if source == "" {
+		source = "0.0.0.0"
+	}
+	conn, err := icmp.ListenPacket(icmpNetwork, source)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	// Closing the connection unblocks reads when shutting down.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return 0, err
+	}
+
+	id, seq := rand.Intn(0xffff), rand.Intn(0xffff)
+	req, err := (&icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: id, Seq: seq, Data: []byte(icmpPayload)},
+	}).Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	if _, err := conn.WriteTo(req, &net.IPAddr{IP: dst}); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			return 0, err
+		}
+		rtt := time.Since(start)
+
+		// Raw sockets receive all the ICMP traffic of the host, including
+		// the replies to the other workers.
+		if addr, ok := peer.(*net.IPAddr); !ok || !addr.IP.Equal(dst) {
+			continue
+		}
+
+		msg, err := icmp.ParseMessage(icmpProtocolIPv4, buf[:n])
+		if err != nil || msg.Type != ipv4.ICMPTypeEchoReply {
+			continue
+		}
+		if echo, ok := msg.Body.(*icmp.Echo); !ok || echo.ID != id || echo.Seq != seq {
+			continue
+		}
+
+		return rtt, nil
+	}
+}
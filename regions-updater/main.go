@@ -1,57 +1,200 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/rs/zerolog"
+	"golang.org/x/net/proxy"
 	"gopkg.in/yaml.v3"
 	corev1 "k8s.io/api/core/v1"
 	kerr "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/retry"
+)
+
+// Build information, set at build time with
+// -ldflags "-X main.version=<version> -X main.commit=<commit> -X main.buildDate=<date>".
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+const (
+	defaultWorkersNumber    uint          = 5
+	defaultSamples          uint          = 1
+	defaultMaxServers       uint          = 100
+	defaultServersListURL   string        = "https://serverlist.piaservers.net/vpninfo/servers/v6"
+	orderByRegionName       string        = "region-name"
+	orderByLatency          string        = "latency"
+	defaultOrderBy          string        = orderByLatency
+	ascendingOrder          string        = "asc"
+	descendingOrder         string        = "desc"
+	defaultOrderDirection   string        = ascendingOrder
+	defaultVerbosity        int           = 1
+	defaultMaxLatency       time.Duration = 50 * time.Millisecond
+	defaultDialTimeout      time.Duration = time.Second
+	defaultFrequency        time.Duration = time.Hour
+	defaultFetchTimeout     time.Duration = time.Minute
+	defaultCycleTimeout     time.Duration = 5 * time.Minute
+	defaultConfMapName      string        = "pia-regions"
+	regionConfMapPrefix     string        = "pia-region-"
+	regionsLabel            string        = "pia.webhook/regions"
+	regionLabel             string        = "pia.webhook/region"
+	contentHashAnnotation   string        = "content-hash"
+	regionsProbedAnnotation string        = "regions-probed"
+	serversKeptAnnotation   string        = "servers-kept"
+	encodingAnnotation      string        = "content-encoding"
+	encodingGzip            string        = "gzip"
+	cycleDurationAnnotation string        = "cycle-duration"
+	formatYAML              string        = "yaml"
+	formatJSON              string        = "json"
+	defaultFormat           string        = formatYAML
+	updateStrategyReplace   string        = "replace"
+	updateStrategyPatch     string        = "patch"
+	defaultUpdateStrategy   string        = updateStrategyReplace
+	outputModeSingle        string        = "single"
+	outputModeSplit         string        = "split"
+	defaultOutputMode       string        = outputModeSingle
+	probeMethodTCP          string        = "tcp"
+	probeMethodICMP         string        = "icmp"
+	probeMethodTLS          string        = "tls"
+	defaultProbeMethod      string        = probeMethodTCP
+	probeTargetIP           string        = "ip"
+	probeTargetCN           string        = "cn"
+	defaultProbeTarget      string        = probeTargetIP
+	ipFamily4               string        = "4"
+	ipFamily6               string        = "6"
+	ipFamilyAny             string        = "any"
+	defaultIPFamily         string        = ipFamilyAny
+	vanInclude              string        = "include"
+	vanExclude              string        = "exclude"
+	vanOnly                 string        = "only"
+	defaultVAN              string        = vanInclude
+	dnsTimeout              time.Duration = 5 * time.Second
+	groupWireGuard          string        = "wg"
+	defaultProbePort        uint          = 443
+	defaultEWMAAlpha        float64       = 1
+	defaultChannelBuffer    uint          = 256
+	defaultMaxObjectBytes   uint          = 1000 * 1000 // Leaves room for the metadata under the 1MiB limit.
+	flushTimeout            time.Duration = 10 * time.Second
+	preflightTimeout        time.Duration = 30 * time.Second
+	minRewriteInterval      time.Duration = 30 * time.Second
+	watchRetryInterval      time.Duration = 10 * time.Second
+	retryAttempts           int           = 3
+	retryBackoff            time.Duration = 2 * time.Second
+	maxFailures             int           = 5
+	namespaceEnv            string        = "NAMESPACE"
+	namespaceFile           string        = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+	kubeconfigEnv           string        = "KUBECONFIG"
+	serversListAuthEnv      string        = "SERVERS_LIST_AUTH_HEADER"
+	logFormatJSON           string        = "json"
+	logFormatConsole        string        = "console"
+	defaultLogFormat        string        = logFormatJSON
 )
 
 const (
-	defaultWorkersNumber     uint          = 5
-	defaultMaxServers        uint          = 100
-	defaultServersListURL    string        = "https://serverlist.piaservers.net/vpninfo/servers/v6"
-	orderByRegionName        string        = "region-name"
-	orderByLatency           string        = "latency"
-	defaultOrderBy           string        = orderByLatency
-	ascendingOrder           string        = "asc"
-	descendingOrder          string        = "desc"
-	defaultOrderDirection    string        = ascendingOrder
-	defaultVerbosity         int           = 1
-	defaultMaxLatency        time.Duration = 50 * time.Millisecond
-	defaultFrequency         time.Duration = time.Hour
-	defaultResultsWriterFreq time.Duration = 5 * time.Minute
-	defaultConfMapName       string        = "pia-regions"
-	namespaceEnv             string        = "NAMESPACE"
+	CodeNoError int = iota
+	CodeBadConfig
+	CodeNoNamespace
+	CodeNoClientset
+	CodeReportFailed
+	CodeStartupDeadline
+	CodeMissingPermissions
+	CodeTooManyFailures
 )
 
 type Options struct {
-	MaxLatency     time.Duration
-	Workers        uint
-	MaxServers     uint
-	ServersListURL string
-	OrderBy        string
-	OrderDirection string
-	Verbosity      int
-	Frequency      time.Duration
+	MaxLatency            time.Duration
+	DialTimeout           time.Duration
+	Workers               uint
+	MaxServers            uint
+	ServersListURL        string
+	ServersListAuth       string
+	OrderBy               string
+	OrderDirection        string
+	Verbosity             int
+	Frequency             time.Duration
+	Format                string
+	Samples               uint
+	ProxyURL              string
+	FetchTimeout          time.Duration
+	VerifySignature       bool
+	SignatureKey          string
+	IPFamily              string
+	CycleTimeout          time.Duration
+	Kubeconfig            string
+	LogFormat             string
+	Report                bool
+	MinPerRegion          uint
+	MaxRegions            uint
+	MaxPerRegion          uint
+	VAN                   string
+	CheckDNS              bool
+	BestPerRegion         bool
+	SOCKS5                string
+	StartupDeadline       time.Duration
+	ProbePort             uint
+	RegionIDs             string
+	ScheduleJitter        time.Duration
+	Seed                  int64
+	EWMAAlpha             float64
+	MaxConcurrentRegions  uint
+	MinFetchInterval      time.Duration
+	UpdateStrategy        string
+	OutputMode            string
+	ProbeMethod           string
+	Warmup                bool
+	ListenAddress         string
+	SampleInterval        time.Duration
+	KeepDegraded          bool
+	GroupByCountry        bool
+	MaxObjectBytes        uint
+	FlushOnShutdown       bool
+	UserAgent             string
+	Version               bool
+	ProbeTarget           string
+	Preflight             bool
+	Compress              bool
+	RecreateOnDelete      bool
+	SourceIP              string
+	RequestBuffer         uint
+	ResultBuffer          uint
+	CacheFile             string
+	TLSInsecureSkipVerify bool
+	TLSCAFile             string
+	MinRegions            uint
+
+	// tlsRootCAs are the certificates loaded from TLSCAFile, or nil to
+	// use the ones of the system.
+	tlsRootCAs *x509.CertPool
 }
 
 func main() {
@@ -62,7 +205,7 @@ func main() {
 	// -----------------------------------
 
 	flag.DurationVar(&opts.MaxLatency, "max-latency", defaultMaxLatency,
-		"Maximum latency tolerated for a server to be kept.")
+		"Maximum latency tolerated for a server to be kept, once averaged with --ewma-alpha.")
 	flag.UintVar(&opts.Workers, "workers", defaultWorkersNumber,
 		"Number of concurrent workers to use for checking latency.")
 	flag.UintVar(&opts.MaxServers, "max-servers", defaultMaxServers,
@@ -77,24 +220,155 @@ func main() {
 		"The log verbosity level, from 0 (verbose) to 3 (silent).")
 	flag.DurationVar(&opts.Frequency, "frequency", defaultFrequency,
 		"The frequency of updating the list of servers.")
+	flag.StringVar(&opts.Format, "format", defaultFormat,
+		fmt.Sprintf("The format of the regions data written to the configmap. Accepted values: %s or %s.", formatYAML, formatJSON))
+	flag.UintVar(&opts.Samples, "samples", defaultSamples,
+		"Number of times each server is probed. The median is used as latency and, if greater than 1, the spread of the samples as jitter.")
+	flag.StringVar(&opts.ProxyURL, "proxy-url", "",
+		"The URL of the proxy to use when getting the list of servers. If empty, HTTP_PROXY and HTTPS_PROXY are used.")
+	flag.DurationVar(&opts.FetchTimeout, "fetch-timeout", defaultFetchTimeout,
+		"Maximum time to wait for the list of servers to be downloaded.")
+	flag.BoolVar(&opts.VerifySignature, "verify-signature", false,
+		"Whether to verify the signature of the servers list.")
+	flag.StringVar(&opts.SignatureKey, "signature-public-key", "",
+		"Path to the PEM encoded public key used to verify the signature of the servers list.")
+	flag.StringVar(&opts.IPFamily, "ip-family", defaultIPFamily,
+		fmt.Sprintf("The IP family of the servers to probe. Accepted values: %s, %s or %s.", ipFamily4, ipFamily6, ipFamilyAny))
+	flag.DurationVar(&opts.CycleTimeout, "cycle-timeout", defaultCycleTimeout,
+		"Maximum time to wait for all servers to be probed before writing the results anyway.")
+	flag.StringVar(&opts.Kubeconfig, "kubeconfig", os.Getenv(kubeconfigEnv),
+		"Path to the kubeconfig file to use when running outside of the cluster. If empty, the in-cluster configuration is used.")
+	flag.StringVar(&opts.LogFormat, "log-format", defaultLogFormat,
+		fmt.Sprintf("The format of the log lines. Accepted values: %s or %s.", logFormatJSON, logFormatConsole))
+	flag.BoolVar(&opts.Report, "report", false,
+		"Probe all servers once, print the fastest server of each region and exit, without writing anything to Kubernetes.")
+	flag.UintVar(&opts.MinPerRegion, "min-servers-per-region", 0,
+		"Minimum number of servers to keep for each region when limiting them with --max-servers. The limit is never exceeded: if it is too low to honor the minimum for all regions, the ones coming first in the sorting order are preferred. Regions dropped by --max-regions are not considered.")
+	flag.UintVar(&opts.MaxRegions, "max-regions", 0,
+		"Maximum number of regions to keep, the ones coming first in the sorting order are preferred. 0 means no limit.")
+	flag.UintVar(&opts.MaxPerRegion, "max-servers-per-region", 0,
+		"Maximum number of servers to keep for each region. 0 means no limit.")
+	flag.StringVar(&opts.VAN, "van", defaultVAN,
+		fmt.Sprintf("Whether to probe servers marked as VAN (virtual) in the servers list. Accepted values: %s, %s or %s.", vanInclude, vanExclude, vanOnly))
+	flag.BoolVar(&opts.CheckDNS, "check-dns", false,
+		"Whether to also resolve the DNS name of the region of each reachable server, to mark it as healthy or not.")
+	flag.BoolVar(&opts.BestPerRegion, "best-per-region", false,
+		"Whether to also write the fastest server of each region, keyed by region ID, under the best key of the configmap.")
+	flag.StringVar(&opts.SOCKS5, "socks5", "",
+		"Address of a SOCKS5 proxy, in the host:port format, to probe servers through. Servers that cannot be reached through it are treated as having a too high latency.")
+	flag.DurationVar(&opts.StartupDeadline, "startup-deadline", 0,
+		"Exit with an error if the configmap has not been written successfully within this time from startup. 0 means no deadline.")
+	flag.UintVar(&opts.ProbePort, "probe-port", defaultProbePort,
+		"The port to probe servers on, used when the servers list does not provide one for WireGuard.")
+	flag.StringVar(&opts.RegionIDs, "region-ids", "",
+		"Comma separated list of the IDs of the regions to probe, e.g. us_california,de_berlin. If empty, all regions are probed.")
+	flag.DurationVar(&opts.ScheduleJitter, "schedule-jitter", 0,
+		"Maximum random delay added to the first cycle and to each following one, so that multiple instances do not fetch the servers list at the same time.")
+	flag.Int64Var(&opts.Seed, "seed", 0,
+		"Seed of the random schedule jitter. 0 means a random seed.")
+	flag.StringVar(&opts.ServersListAuth, "servers-list-auth-header", "",
+		fmt.Sprintf("Value of the Authorization header sent when downloading the servers list, e.g. \"Bearer <token>\". Can also be set with the %s environment variable.", serversListAuthEnv))
+	flag.Float64Var(&opts.EWMAAlpha, "ewma-alpha", defaultEWMAAlpha,
+		"Weight of the latest latency of a server when averaging it with the ones of previous cycles, between 0 (excluded) and 1. 1 means no smoothing.")
+	flag.DurationVar(&opts.DialTimeout, "dial-timeout", defaultDialTimeout,
+		"Maximum time to wait for a connection to a server. It must not be lower than --max-latency, so that servers slightly slower than that can be told apart from unreachable ones.")
+	flag.UintVar(&opts.MaxConcurrentRegions, "max-concurrent-regions", 0,
+		"Maximum number of regions whose servers are probed at the same time. 0 means no limit.")
+	flag.DurationVar(&opts.MinFetchInterval, "min-fetch-interval", 0,
+		"Minimum time between two downloads of the servers list. Cycles requested earlier than that, e.g. with SIGHUP, are delayed. 0 means no limit.")
+	flag.StringVar(&opts.UpdateStrategy, "update-strategy", defaultUpdateStrategy,
+		fmt.Sprintf("How to update an existing configmap: %s sends the whole configmap as last read, and is retried if someone else changed it in the meantime, %s only sends the keys, labels and annotations written by this program. Both keep the ones written by others. Accepted values: %s or %s.", updateStrategyReplace, updateStrategyPatch, updateStrategyReplace, updateStrategyPatch))
+	flag.StringVar(&opts.OutputMode, "output-mode", defaultOutputMode,
+		fmt.Sprintf("Whether to write all regions to a single configmap (%s) or each region to its own configmap, named %s<region-id> and labeled %s (%s). Accepted values: %s or %s.", outputModeSingle, regionConfMapPrefix, regionsLabel, outputModeSplit, outputModeSingle, outputModeSplit))
+	flag.StringVar(&opts.ProbeMethod, "probe-method", defaultProbeMethod,
+		fmt.Sprintf("How to measure the latency of servers: %s connects to them, %s sends ICMP echo requests to IPv4 servers and needs the NET_RAW capability: if it is not permitted, TCP is used. %s connects to them and completes a TLS handshake, with their common name as server name. Accepted values: %s, %s or %s.", probeMethodTCP, probeMethodICMP, probeMethodTLS, probeMethodTCP, probeMethodICMP, probeMethodTLS))
+	flag.BoolVar(&opts.Warmup, "warmup", false,
+		"Whether to connect to each server once before measuring its latency, discarding the result.")
+	flag.StringVar(&opts.ListenAddress, "listen-address", "",
+		"The address to serve the latest written regions on, at /regions, in the host:port format. If empty, they are not served.")
+	flag.DurationVar(&opts.SampleInterval, "sample-interval", 0,
+		"Time to wait between two latency samples of the same server, so that they are independent from each other.")
+	flag.BoolVar(&opts.KeepDegraded, "keep-degraded", false,
+		"Whether to keep servers that could not be probed or are too slow, marked as degraded and without a latency, after all the other ones. They can be used as a last resort.")
+	flag.BoolVar(&opts.GroupByCountry, "group-by-country", false,
+		"Whether to also write the regions grouped by country, under the countries key of the configmap. Ignored with --output-mode=split.")
+	flag.UintVar(&opts.MaxObjectBytes, "max-object-bytes", defaultMaxObjectBytes,
+		"Maximum size of the data written to the configmap, once compressed with --compress. The slowest servers are dropped until it fits, whatever --order-by is. 0 means no limit. Ignored with --output-mode=split.")
+	flag.BoolVar(&opts.FlushOnShutdown, "flush-on-shutdown", false,
+		"Whether to write the results collected so far by the current cycle when shutting down.")
+	flag.StringVar(&opts.UserAgent, "user-agent", "pia-mutating-webhook/"+version,
+		"The User-Agent to send when getting the list of servers.")
+	flag.BoolVar(&opts.Version, "version", false,
+		"Print the version, commit and build date, then exit.")
+	flag.StringVar(&opts.ProbeTarget, "probe-target", defaultProbeTarget,
+		fmt.Sprintf("What to connect to when probing servers: %s uses their IP, %s their common name, which must be resolvable. ICMP probes always use the IP. Accepted values: %s or %s.", probeTargetIP, probeTargetCN, probeTargetIP, probeTargetCN))
+	flag.BoolVar(&opts.Preflight, "preflight", false,
+		"Whether to check at startup that the service account can write configmaps, and exit if it cannot.")
+	flag.BoolVar(&opts.Compress, "compress", false,
+		"Whether to compress the data written to the configmap with gzip. The content-encoding annotation is set to gzip when it is.")
+	flag.BoolVar(&opts.RecreateOnDelete, "recreate-on-delete", false,
+		"Whether to watch the configmaps and write them again as soon as they are deleted, instead of waiting for the next cycle. They are written again at most once every "+minRewriteInterval.String()+".")
+	flag.StringVar(&opts.SourceIP, "source-ip", "",
+		"The local IP to probe servers from, which must be assigned to one of the interfaces. Servers of the other IP family cannot be probed. With --socks5, it is used to connect to the proxy.")
+	flag.UintVar(&opts.RequestBuffer, "request-buffer", defaultChannelBuffer,
+		"Number of servers that can wait to be probed. When full, dispatching servers blocks until a worker is free, so a smaller buffer uses less memory without slowing down probing.")
+	flag.UintVar(&opts.ResultBuffer, "result-buffer", defaultChannelBuffer,
+		"Number of probe results that can wait to be collected. When full, workers block until results are collected, which only happens with very large lists and many workers.")
+	flag.StringVar(&opts.CacheFile, "cache-file", "",
+		"Path of a file where the results of the last cycle are saved, e.g. on a persistent volume. They are loaded and written at startup, before the first cycle completes.")
+	flag.BoolVar(&opts.TLSInsecureSkipVerify, "tls-insecure-skip-verify", false,
+		"Whether to skip the verification of the server certificates with --probe-method=tls.")
+	flag.StringVar(&opts.TLSCAFile, "tls-ca-file", "",
+		"Path of a PEM file with the certificate authorities to verify the server certificates with --probe-method=tls, instead of the ones of the system. PIA servers use certificates signed by the PIA certificate authority.")
+	flag.UintVar(&opts.MinRegions, "min-regions", 0,
+		"Minimum number of regions with at least one server that responded in time for the results to be written. When there are fewer, existing data is kept, but the results are still written if there is none. 0 means no minimum.")
 	flag.Parse()
 
-	log := zerolog.New(os.Stderr).With().Timestamp().Logger()
-	log.Info().Msg("starting...")
+	if opts.Version {
+		fmt.Printf("%s (commit %s, built %s)\n", version, commit, buildDate)
+		os.Exit(CodeNoError)
+	}
+
+	// The environment variable is only read now, so that its value is
+	// never printed as the default of the flag in the usage.
+	if opts.ServersListAuth == "" {
+		opts.ServersListAuth = os.Getenv(serversListAuthEnv)
+	}
+
+	os.Exit(run(opts))
+}
+
+func run(opts *Options) int {
+	var logOutput io.Writer = os.Stderr
+	if strings.EqualFold(opts.LogFormat, logFormatConsole) {
+		logOutput = zerolog.ConsoleWriter{Out: os.Stderr}
+	}
+
+	log := zerolog.New(logOutput).With().Timestamp().Logger()
+	log.Info().Str("version", version).Str("commit", commit).
+		Str("build-date", buildDate).Msg("starting...")
 
 	// -----------------------------------
 	// Get Kubernetes clientset and data
 	// -----------------------------------
 
-	namespace := os.Getenv(namespaceEnv)
-	if namespace == "" {
-		log.Fatal().Msg("could not get namespace from enviroment variables")
-		return
-	}
+	var (
+		namespace string
+		clientset *kubernetes.Clientset
+		err       error
+	)
+	if !opts.Report {
+		namespace, err = getNamespace()
+		if err != nil {
+			log.Error().Err(err).Msg("could not get namespace")
+			return CodeNoNamespace
+		}
 
-	clientset, err := getKubernetesClientset()
-	if err != nil {
-		log.Fatal().Err(err).Msg("could not get Kubernetes clientset")
+		clientset, err = getKubernetesClientset(opts.Kubeconfig)
+		if err != nil {
+			log.Error().Err(err).Msg("could not get Kubernetes clientset")
+			return CodeNoClientset
+		}
 	}
 
 	// -----------------------------------
@@ -109,42 +383,307 @@ func main() {
 			zerolog.FatalLevel,
 		}
 		if opts.Verbosity < 0 || opts.Verbosity > len(logLevels)-1 {
-			log.Fatal().Err(fmt.Errorf("invalid verbosity level")).Msg("")
+			log.Error().Err(fmt.Errorf("invalid verbosity level")).Msg("")
+			return CodeBadConfig
 		}
 		log = log.Level(logLevels[opts.Verbosity])
 	}
 
+	if !strings.EqualFold(opts.LogFormat, logFormatJSON) &&
+		!strings.EqualFold(opts.LogFormat, logFormatConsole) {
+		log.Error().Err(fmt.Errorf("unknown log format")).
+			Str("log-format", opts.LogFormat).Msg("")
+		return CodeBadConfig
+	}
+
 	if opts.MaxLatency == 0 {
-		log.Fatal().Err(fmt.Errorf("invalid max latency provided")).
+		log.Error().Err(fmt.Errorf("invalid max latency provided")).
 			Dur("max-latency", opts.MaxLatency).Msg("")
+		return CodeBadConfig
 	}
 
-	if opts.Workers == 0 {
-		log.Debug().Uint("workers", opts.Workers).
-			Uint("default-workers-number", defaultWorkersNumber).
-			Msg("invalid workers flag provided: using default value...")
+	if opts.DialTimeout < opts.MaxLatency {
+		log.Error().Err(fmt.Errorf("dial timeout is lower than the max latency")).
+			Dur("dial-timeout", opts.DialTimeout).
+			Dur("max-latency", opts.MaxLatency).Msg("")
+		return CodeBadConfig
+	}
+
+	if opts.RequestBuffer == 0 || opts.ResultBuffer == 0 {
+		log.Error().Err(fmt.Errorf("invalid channel buffer size provided")).
+			Uint("request-buffer", opts.RequestBuffer).
+			Uint("result-buffer", opts.ResultBuffer).Msg("")
+		return CodeBadConfig
+	}
+
+	if opts.Samples == 0 {
+		log.Error().Err(fmt.Errorf("invalid number of samples provided")).
+			Uint("samples", opts.Samples).Msg("")
+		return CodeBadConfig
 	}
 
 	if opts.MaxServers == 0 {
 		log.Debug().Msg("using no limits for maximum servers to list")
 	}
 
-	if _, err := url.Parse(opts.ServersListURL); err != nil {
-		log.Fatal().Err(err).Str("servers-list-url", opts.ServersListURL).
+	if opts.MaxPerRegion > 0 && opts.MinPerRegion > opts.MaxPerRegion {
+		log.Error().Err(fmt.Errorf("minimum servers per region is greater than the maximum")).
+			Uint("min-servers-per-region", opts.MinPerRegion).
+			Uint("max-servers-per-region", opts.MaxPerRegion).Msg("")
+		return CodeBadConfig
+	}
+
+	if listURL, err := url.Parse(opts.ServersListURL); err != nil {
+		log.Error().Err(err).Str("servers-list-url", opts.ServersListURL).
+			Msg("invalid servers list url provided")
+		return CodeBadConfig
+	} else if _, err := filePath(listURL); listURL.Scheme == "file" && err != nil {
+		log.Error().Err(err).Str("servers-list-url", opts.ServersListURL).
 			Msg("invalid servers list url provided")
+		return CodeBadConfig
+	}
+
+	if opts.FetchTimeout <= 0 {
+		log.Error().Err(fmt.Errorf("invalid fetch timeout provided")).
+			Dur("fetch-timeout", opts.FetchTimeout).Msg("")
+		return CodeBadConfig
+	}
+
+	if opts.CycleTimeout <= 0 {
+		log.Error().Err(fmt.Errorf("invalid cycle timeout provided")).
+			Dur("cycle-timeout", opts.CycleTimeout).Msg("")
+		return CodeBadConfig
+	}
+
+	var sourceIP net.IP
+	if opts.SourceIP != "" {
+		if sourceIP = net.ParseIP(opts.SourceIP); sourceIP == nil {
+			log.Error().Err(fmt.Errorf("invalid source ip provided")).
+				Str("source-ip", opts.SourceIP).Msg("")
+			return CodeBadConfig
+		}
+
+		local, err := isLocalIP(sourceIP)
+		if err != nil {
+			log.Error().Err(err).Msg("could not get the addresses of the interfaces")
+			return CodeBadConfig
+		}
+		if !local {
+			log.Error().Err(fmt.Errorf("source ip is not assigned to any interface")).
+				Str("source-ip", opts.SourceIP).Msg("")
+			return CodeBadConfig
+		}
+	}
+
+	probeDialer, err := getProbeDialer(opts.SOCKS5, sourceIP, opts.DialTimeout)
+	if err != nil {
+		log.Error().Err(err).Str("socks5", opts.SOCKS5).
+			Msg("invalid socks5 address provided")
+		return CodeBadConfig
+	}
+
+	if opts.EWMAAlpha <= 0 || opts.EWMAAlpha > 1 {
+		log.Error().Err(fmt.Errorf("invalid ewma alpha provided")).
+			Float64("ewma-alpha", opts.EWMAAlpha).Msg("")
+		return CodeBadConfig
+	}
+
+	if opts.ListenAddress != "" {
+		if _, _, err := net.SplitHostPort(opts.ListenAddress); err != nil {
+			log.Error().Err(err).Str("listen-address", opts.ListenAddress).
+				Msg("invalid listen address provided")
+			return CodeBadConfig
+		}
+	}
+
+	if opts.SampleInterval < 0 {
+		log.Error().Err(fmt.Errorf("invalid sample interval provided")).
+			Dur("sample-interval", opts.SampleInterval).Msg("")
+		return CodeBadConfig
+	}
+
+	if opts.MinFetchInterval < 0 {
+		log.Error().Err(fmt.Errorf("invalid min fetch interval provided")).
+			Dur("min-fetch-interval", opts.MinFetchInterval).Msg("")
+		return CodeBadConfig
+	}
+
+	if opts.ScheduleJitter < 0 {
+		log.Error().Err(fmt.Errorf("invalid schedule jitter provided")).
+			Dur("schedule-jitter", opts.ScheduleJitter).Msg("")
+		return CodeBadConfig
+	}
+
+	if opts.ProbePort == 0 || opts.ProbePort > 65535 {
+		log.Error().Err(fmt.Errorf("invalid probe port provided")).
+			Uint("probe-port", opts.ProbePort).Msg("")
+		return CodeBadConfig
+	}
+
+	if opts.StartupDeadline < 0 {
+		log.Error().Err(fmt.Errorf("invalid startup deadline provided")).
+			Dur("startup-deadline", opts.StartupDeadline).Msg("")
+		return CodeBadConfig
+	}
+
+	if opts.ServersListAuth != "" {
+		log.Info().Str("servers-list-auth-header", redact(opts.ServersListAuth)).
+			Msg("using authentication for the servers list")
+	}
+
+	httpClient, err := getHTTPClient(opts.ProxyURL, opts.FetchTimeout)
+	if err != nil {
+		log.Error().Err(err).Str("proxy-url", opts.ProxyURL).
+			Msg("invalid proxy url provided")
+		return CodeBadConfig
+	}
+
+	var signatureKey *rsa.PublicKey
+	if opts.VerifySignature {
+		if opts.SignatureKey == "" {
+			log.Error().Err(fmt.Errorf("no public key provided to verify the signature")).Msg("")
+			return CodeBadConfig
+		}
+
+		signatureKey, err = loadPublicKey(opts.SignatureKey)
+		if err != nil {
+			log.Error().Err(err).Str("signature-public-key", opts.SignatureKey).
+				Msg("could not load public key")
+			return CodeBadConfig
+		}
 	}
 
 	if !strings.EqualFold(opts.OrderBy, orderByRegionName) &&
 		!strings.EqualFold(opts.OrderBy, orderByLatency) {
-		log.Fatal().Err(fmt.Errorf("unknown order type")).
+		log.Error().Err(fmt.Errorf("unknown order type")).
 			Str("order-by", opts.OrderBy).Msg("")
+		return CodeBadConfig
 	}
 
 	if !strings.EqualFold(opts.OrderDirection, ascendingOrder) &&
 		!strings.EqualFold(opts.OrderDirection, descendingOrder) {
-		log.Fatal().Err(fmt.Errorf("unknown order direction")).
+		log.Error().Err(fmt.Errorf("unknown order direction")).
 			Str("order-direction", opts.OrderDirection).
 			Msg("")
+		return CodeBadConfig
+	}
+
+	if opts.IPFamily != ipFamily4 && opts.IPFamily != ipFamily6 &&
+		!strings.EqualFold(opts.IPFamily, ipFamilyAny) {
+		log.Error().Err(fmt.Errorf("unknown ip family")).
+			Str("ip-family", opts.IPFamily).Msg("")
+		return CodeBadConfig
+	}
+
+	if !strings.EqualFold(opts.VAN, vanInclude) &&
+		!strings.EqualFold(opts.VAN, vanExclude) &&
+		!strings.EqualFold(opts.VAN, vanOnly) {
+		log.Error().Err(fmt.Errorf("unknown van mode")).
+			Str("van", opts.VAN).Msg("")
+		return CodeBadConfig
+	}
+
+	if !strings.EqualFold(opts.ProbeMethod, probeMethodTCP) &&
+		!strings.EqualFold(opts.ProbeMethod, probeMethodICMP) &&
+		!strings.EqualFold(opts.ProbeMethod, probeMethodTLS) {
+		log.Error().Err(fmt.Errorf("unknown probe method")).
+			Str("probe-method", opts.ProbeMethod).Msg("")
+		return CodeBadConfig
+	}
+
+	if !strings.EqualFold(opts.ProbeTarget, probeTargetIP) &&
+		!strings.EqualFold(opts.ProbeTarget, probeTargetCN) {
+		log.Error().Err(fmt.Errorf("unknown probe target")).
+			Str("probe-target", opts.ProbeTarget).Msg("")
+		return CodeBadConfig
+	}
+
+	if opts.TLSCAFile != "" {
+		rootCAs, err := loadCertPool(opts.TLSCAFile)
+		if err != nil {
+			log.Error().Err(err).Str("tls-ca-file", opts.TLSCAFile).
+				Msg("could not load certificate authorities")
+			return CodeBadConfig
+		}
+		opts.tlsRootCAs = rootCAs
+	}
+
+	if strings.EqualFold(opts.ProbeMethod, probeMethodICMP) {
+		if opts.SOCKS5 != "" {
+			log.Error().Err(fmt.Errorf("icmp probes cannot go through a socks5 proxy")).
+				Str("probe-method", opts.ProbeMethod).Str("socks5", opts.SOCKS5).Msg("")
+			return CodeBadConfig
+		}
+
+		if err := checkICMP(); err != nil {
+			log.Warn().Err(err).Msg("icmp is not permitted, falling back to tcp...")
+			opts.ProbeMethod = probeMethodTCP
+		}
+	}
+
+	if !strings.EqualFold(opts.OutputMode, outputModeSingle) &&
+		!strings.EqualFold(opts.OutputMode, outputModeSplit) {
+		log.Error().Err(fmt.Errorf("unknown output mode")).
+			Str("output-mode", opts.OutputMode).Msg("")
+		return CodeBadConfig
+	}
+
+	if !strings.EqualFold(opts.UpdateStrategy, updateStrategyReplace) &&
+		!strings.EqualFold(opts.UpdateStrategy, updateStrategyPatch) {
+		log.Error().Err(fmt.Errorf("unknown update strategy")).
+			Str("update-strategy", opts.UpdateStrategy).Msg("")
+		return CodeBadConfig
+	}
+
+	if !strings.EqualFold(opts.Format, formatYAML) &&
+		!strings.EqualFold(opts.Format, formatJSON) {
+		log.Error().Err(fmt.Errorf("unknown output format")).
+			Str("format", opts.Format).Msg("")
+		return CodeBadConfig
+	}
+
+	if opts.Report {
+		ctx, canc := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		err := report(ctx, os.Stdout, httpClient, probeDialer, signatureKey, log, opts)
+		canc()
+		if err != nil {
+			log.Error().Err(err).Msg("could not create report")
+			return CodeReportFailed
+		}
+
+		return CodeNoError
+	}
+
+	if opts.Preflight {
+		ctx, canc := context.WithTimeout(context.Background(), preflightTimeout)
+		missing, err := missingVerbs(ctx, clientset, namespace, requiredVerbs(opts))
+		canc()
+		if err != nil {
+			log.Error().Err(err).Msg("could not check permissions on configmaps")
+			return CodeMissingPermissions
+		}
+
+		if len(missing) > 0 {
+			log.Error().Err(fmt.Errorf("missing permissions on configmaps, check the role of the service account")).
+				Str("namespace", namespace).Strs("verbs", missing).Msg("")
+			return CodeMissingPermissions
+		}
+	}
+
+	// -----------------------------------
+	// Start server
+	// -----------------------------------
+
+	store := &resultsStore{}
+	var server *http.Server
+	if opts.ListenAddress != "" {
+		server = newServer(opts.ListenAddress, store, log)
+		go func() {
+			log.Info().Str("listen-address", opts.ListenAddress).Msg("listening...")
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Err(err).Msg("error while starting server")
+			}
+		}()
 	}
 
 	// -----------------------------------
@@ -154,23 +693,14 @@ func main() {
 	ctx, canc := context.WithCancel(context.Background())
 
 	// The request chan, containing the server to test.
-	reqChan := make(chan *ServerLatency, 256)
+	reqChan := make(chan *ServerLatency, opts.RequestBuffer)
 
 	// The result chan, containing the same structure set to reqChan but with
 	// the Latency field set.
-	resChan := make(chan *ServerLatency, 256)
+	resChan := make(chan *ServerLatency, opts.ResultBuffer)
 
 	wg := sync.WaitGroup{}
-	for i := 0; i < int(opts.Workers); i++ {
-		wg.Add(1)
-		go func(wid int) {
-			defer wg.Done()
-
-			log.Info().Int("worker", wid+1).Msg("worker starting...")
-			work(ctx, reqChan, resChan, log, opts.MaxLatency)
-			log.Info().Int("worker", wid+1).Msg("worker exited")
-		}(i)
-	}
+	startWorkers(ctx, &wg, probeDialer, reqChan, resChan, log, opts)
 
 	// -----------------------------------
 	// Handle events
@@ -179,116 +709,471 @@ func main() {
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM, syscall.SIGABRT)
 
-	updateTicker := time.NewTicker(opts.Frequency)
-	confWriterTimer := time.NewTimer(time.Second)
+	// SIGHUP forces a new cycle without waiting for the next tick.
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+
+	jitter := newJitter(opts.ScheduleJitter, opts.Seed)
+
+	// A timer is used instead of a ticker, so that each cycle can have a
+	// different jitter.
+	updateTimer := time.NewTimer(opts.Frequency + jitter())
+
+	// The results are written as soon as all servers have been probed, this
+	// is only a backstop in case some of them never are.
+	confWriterTimer := time.NewTimer(opts.CycleTimeout)
+	confWriterTimer.Stop()
+
+	// The number of servers dispatched to the workers in the current cycle,
+	// sent once the dispatch is complete along with the IDs of the regions
+	// in the servers list. It is 0 if the list could not be loaded.
+	dispatchedChan := make(chan dispatchResult, 1)
+	var fetchedRegions map[string]bool
+
+	// Transient errors are retried right away, while permanent ones are
+	// counted: the process exits if fetching or writing keeps failing, so
+	// that the problem shows up as a restarting pod.
+	fetchFailures := &failureCounter{limit: maxFailures}
+	writeFailures := &failureCounter{limit: maxFailures}
+	failed := make(chan error, 1)
+	notifyFailure := func(err error) {
+		select {
+		case failed <- err:
+		default:
+		}
+	}
+
+	// The results of the current cycle, which is in progress from when the
+	// servers list is requested until the results are written, so that two
+	// cycles never overlap.
+	col := newCollector(opts.KeepDegraded, opts.MaxLatency, opts.EWMAAlpha)
+
+	// When the current cycle started, written as an annotation.
+	cycleStart := time.Time{}
 
 	// This will be used to trigger the first iteration
-	firstTime := time.NewTimer(5 * time.Second)
+	firstTime := time.NewTimer(5*time.Second + jitter())
+
+	// The process exits if nothing is written before the startup deadline,
+	// so that Kubernetes can restart it. written is notified after every
+	// successful write.
+	var startupDeadline <-chan time.Time
+	if opts.StartupDeadline > 0 {
+		startupTimer := time.NewTimer(opts.StartupDeadline)
+		defer startupTimer.Stop()
+		startupDeadline = startupTimer.C
+	}
+	written := make(chan struct{}, 1)
+
+	// Cycles requested too soon after the last fetch are delayed with
+	// delayedCycle, and all requests coming in the meantime are coalesced.
+	lastFetch := time.Time{}
+	delayedCycle := time.NewTimer(opts.MinFetchInterval)
+	delayedCycle.Stop()
+	delayed := false
+
+	startCycle := func() {
+		if col.cycling {
+			log.Info().Msg("a cycle is already in progress, skipping...")
+			return
+		}
 
-	latResults := []*ServerLatency{}
-	stopping := false
-	for !stopping {
-		select {
-		case <-updateTicker.C:
-		case <-firstTime.C:
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
+		if wait := opts.MinFetchInterval - time.Since(lastFetch); !lastFetch.IsZero() && wait > 0 {
+			if !delayed {
+				log.Info().Dur("wait", wait).Msg("servers list fetched too recently, delaying cycle...")
+				delayedCycle.Reset(wait)
+				delayed = true
+			}
+			return
+		}
+
+		if delayed {
+			delayedCycle.Stop()
+			delayed = false
+		}
+		lastFetch = time.Now()
+
+		// Whatever is left of the cycle when it ends is stopped, so that
+		// the workers don't probe servers whose results would be dropped.
+		cycleCtx, cycleCanc := context.WithCancel(ctx)
+		cycle := col.start(cycleCanc)
+		fetchedRegions = nil
+		cycleStart = time.Now()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
 
-				servListCtx, servListCanc := context.WithTimeout(ctx, time.Minute)
+			log.Debug().Msg("getting list of servers...")
+			var list *ServersListResponse
+			err := retryTransient(cycleCtx, retryAttempts, retryBackoff, func() error {
+				servListCtx, servListCanc := context.WithTimeout(cycleCtx, opts.FetchTimeout)
 				defer servListCanc()
 
-				log.Debug().Msg("getting list of servers...")
-				regions, err := getServersList(servListCtx, opts.ServersListURL)
+				var err error
+				list, err = getServersList(servListCtx, httpClient, opts.ServersListURL, opts.ServersListAuth, opts.UserAgent, signatureKey)
+				return err
+			})
+			if cycleCtx.Err() != nil {
+				return
+			}
+			if fetchFailures.record(err) {
+				notifyFailure(err)
+			}
+			if err != nil {
+				log.Err(err).Bool("transient", isTransient(err)).
+					Msg("could not load regions, skipping...")
+				dispatchedChan <- dispatchResult{cycle: cycle}
+				return
+			}
+
+			log.Info().Msg("calculating latencies...")
+
+			port := list.Port(groupWireGuard, uint16(opts.ProbePort))
+			regions := filterRegions(list.Regions, opts.RegionIDs)
+			if len(regions) == 0 {
+				log.Warn().Str("region-ids", opts.RegionIDs).
+					Msg("no regions match the provided ids")
+			}
+			regions = filterVAN(regions, opts.VAN)
+			count, err := dispatch(cycleCtx, reqChan, regions, port, opts.MaxConcurrentRegions, cycle)
+			if err != nil {
+				log.Debug().Int("dispatched", count).Msg("stopped dispatching servers")
+				return
+			}
+
+			regionIDs := map[string]bool{}
+			for _, region := range regions {
+				regionIDs[region.ID] = true
+			}
+			dispatchedChan <- dispatchResult{cycle: cycle, count: count, regionIDs: regionIDs}
+		}()
+
+		confWriterTimer.Reset(opts.CycleTimeout)
+	}
+
+	// Writes are serialized, as they sort the results in place and an older
+	// write must not overwrite a newer one.
+	var writeMu sync.Mutex
+
+	// The results of the last cycle, written again if the configmap is
+	// deleted.
+	var (
+		lastResults   []*ServerLatency
+		lastRegionIDs map[string]bool
+		lastStats     cycleStats
+		lastRewrite   time.Time
+	)
+
+	// write writes results in the background, giving up when parent is
+	// done.
+	write := func(parent context.Context, results []*ServerLatency, regionIDs map[string]bool, stats cycleStats) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			writeMu.Lock()
+			defer writeMu.Unlock()
+
+			wrtCtx, wrtCanc := context.WithTimeout(parent, time.Minute)
+			defer wrtCanc()
+
+			// The cache holds the results as they were collected, as the
+			// options may be different at the next start.
+			cached := &cache{Results: results, RegionIDs: regionIDs, Stats: stats}
+
+			// Degraded servers have no latency, so they always come last.
+			results, degraded := splitDegraded(results)
+			sortResults(results, opts.OrderBy, opts.OrderDirection)
+			sortRegionServers(results, opts.OrderDirection)
+			results = append(results, degraded...)
+			results = limitRegions(results, opts.MaxRegions, opts.MaxPerRegion)
+			results = truncateResults(results, opts.MaxServers, opts.MinPerRegion)
+
+			stats.ServersKept = len(results)
+
+			// A cycle that went wrong, e.g. because of the network of the
+			// node, must not replace data that was good: it is only written
+			// if there is nothing to replace.
+			if healthy := len(bestPerRegion(results)); healthy < int(opts.MinRegions) {
+				exists, err := hasWrittenData(wrtCtx, clientset, namespace, opts.OutputMode)
 				if err != nil {
-					// TODO: auto-exit if failed too many times in a row
-					log.Err(err).Msg("could not load regions, skipping...")
+					log.Err(err).Msg("could not check existing configmaps, skipping...")
+					return
+				}
+
+				if exists {
+					log.Warn().Int("healthy-regions", healthy).Uint("min-regions", opts.MinRegions).
+						Msg("not enough healthy regions, keeping existing data...")
 					return
 				}
+			}
+
+			var best map[string]*Server
+			if opts.BestPerRegion {
+				best = map[string]*Server{}
+				for id, res := range bestPerRegion(results) {
+					best[id] = res.Server
+				}
+			}
 
-				log.Info().Msg("calculating latencies...")
+			var err error
+			if strings.EqualFold(opts.OutputMode, outputModeSplit) {
+				err = retryTransient(wrtCtx, retryAttempts, retryBackoff, func() error {
+					return updateRegionConfigMaps(wrtCtx, clientset, namespace, opts.Format, opts.UpdateStrategy, opts.Compress, results, regionIDs, stats)
+				})
+			} else {
+				cmData := configMapData{Regions: results, Best: best}
+				if opts.GroupByCountry {
+					cmData.Countries = groupByCountry(results)
+				}
 
-				for _, region := range regions {
-					if region.Servers == nil {
-						continue
+				if opts.MaxObjectBytes > 0 {
+					var dropped int
+					cmData, dropped, err = fitConfigMapData(opts.Format, opts.Compress, cmData, opts.MaxObjectBytes)
+					if err != nil {
+						log.Err(err).Uint("max-object-bytes", opts.MaxObjectBytes).
+							Msg("could not fit results in configmap, keeping existing data...")
+						return
 					}
 
-					// TODO: we're only concentrating on WireGuard for now. So we skip
-					// this if it doesn't have any.
-					for _, serv := range region.Servers.WireGuard {
-						reqChan <- &ServerLatency{
-							Server: serv,
-							Region: region,
-						}
+					if dropped > 0 {
+						log.Warn().Int("dropped", dropped).
+							Uint("max-object-bytes", opts.MaxObjectBytes).
+							Msg("configmap would be too large, dropped servers")
+						results = cmData.Regions
+						stats.ServersKept = len(results)
 					}
 				}
-			}()
 
-			// After some minutes, this will activate and will write results
-			// TODO: if user sets a long timeout, this may not be enough and
-			// may leave out some results.
-			confWriterTimer = time.NewTimer(time.Minute)
-
-		case <-confWriterTimer.C:
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
+				err = retryTransient(wrtCtx, retryAttempts, retryBackoff, func() error {
+					return updateConfigMap(wrtCtx, clientset, namespace, defaultConfMapName, nil, opts.Format, opts.UpdateStrategy, opts.Compress, cmData, stats)
+				})
+			}
+			if writeFailures.record(err) {
+				notifyFailure(err)
+			}
+			if err != nil {
+				log.Err(err).Bool("transient", isTransient(err)).
+					Msg("could not update configmap, skipping...")
+				return
+			}
 
-				wrtCtx, wrtCanc := context.WithTimeout(ctx, time.Minute)
-				defer wrtCanc()
+			store.Set(results)
 
-				if opts.MaxServers > 0 && len(latResults) > int(opts.MaxServers) {
-					latResults = latResults[:opts.MaxServers]
+			if opts.CacheFile != "" {
+				if err := saveCache(opts.CacheFile, cached); err != nil {
+					log.Warn().Err(err).Str("cache-file", opts.CacheFile).
+						Msg("could not save results to cache")
 				}
+			}
 
-				// Sort the results.
-				var sortIface sort.Interface
-				switch opts.OrderBy {
-				case orderByLatency:
-					if opts.OrderDirection == ascendingOrder {
-						sortIface = byLowerLatency(latResults)
-					} else {
-						sortIface = byGreaterLatency(latResults)
-					}
-				case orderByRegionName:
-					if opts.OrderDirection == ascendingOrder {
-						sortIface = byLowerRegionName(latResults)
-					} else {
-						sortIface = byGreaterRegionName(latResults)
-					}
-				}
+			select {
+			case written <- struct{}{}:
+			default:
+			}
+		}()
+	}
+
+	// writeResults ends the current cycle and writes its results, giving up
+	// when parent is done.
+	writeResults := func(parent context.Context) {
+		confWriterTimer.Stop()
+
+		// Results only belong to a single cycle: hand them over to the
+		// writer, the late ones are dropped by the collector.
+		probed, measured, degraded, probedRegions := col.probed, col.measured, col.degraded, len(col.regions)
+		results := col.end()
+		regionIDs := fetchedRegions
+		stats := cycleStats{
+			RegionsProbed: probedRegions,
+			Duration:      time.Since(cycleStart),
+		}
+
+		summary := log.Info().Int("regions-probed", stats.RegionsProbed).
+			Int("servers-probed", probed).Int("servers-measured", measured).
+			Int("servers-degraded", degraded).Int("servers-dropped", probed-len(results)).
+			Str("duration", stats.Duration.Round(time.Millisecond).String())
+		if fastest, slowest := regionExtremes(results); fastest != nil {
+			summary = summary.
+				Str("fastest-region", fastest.Region.ID).Str("fastest-latency", fastest.Latency.String()).
+				Str("slowest-region", slowest.Region.ID).Str("slowest-latency", slowest.Latency.String())
+		}
+		summary.Msg("cycle completed")
+
+		lastResults, lastRegionIDs, lastStats = results, regionIDs, stats
+		write(parent, results, regionIDs, stats)
+	}
+
+	// deleted receives the names of the configmaps deleted by someone else.
+	deleted := make(chan string, 1)
+	if opts.RecreateOnDelete {
+		listOpts := metav1.ListOptions{FieldSelector: "metadata.name=" + defaultConfMapName}
+		if strings.EqualFold(opts.OutputMode, outputModeSplit) {
+			listOpts = metav1.ListOptions{LabelSelector: regionsLabel}
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			watchDeletions(ctx, clientset, namespace, listOpts, deleted, log)
+		}()
+	}
 
-				sort.Sort(sortIface)
+	// The cached results are written right away, so that the configmap is
+	// not stale until the first cycle completes.
+	if opts.CacheFile != "" {
+		cached, err := loadCache(opts.CacheFile)
+		switch {
+		case err != nil:
+			log.Warn().Err(err).Str("cache-file", opts.CacheFile).
+				Msg("could not load cached results, ignoring...")
+		case cached != nil && len(cached.Results) > 0:
+			log.Info().Int("servers", len(cached.Results)).
+				Msg("writing cached results...")
+			lastResults, lastRegionIDs, lastStats = cached.Results, cached.RegionIDs, cached.Stats
+			col.seed(cached.Results)
+			write(ctx, cached.Results, cached.RegionIDs, cached.Stats)
+		}
+	}
 
-				if err := updateConfigMap(wrtCtx, clientset, namespace, latResults); err != nil {
-					// TODO: keep track of the number of times this failed, and
-					// close if it failed too many times.
-					log.Err(err).Msg("could not update configmap, skipping...")
+	exitCode := CodeNoError
+	stopping := false
+	for !stopping {
+		select {
+		case <-updateTimer.C:
+			updateTimer.Reset(opts.Frequency + jitter())
+			startCycle()
+		case <-firstTime.C:
+			startCycle()
+		case <-reload:
+			log.Info().Msg("reload requested")
+			startCycle()
+		case <-delayedCycle.C:
+			delayed = false
+			startCycle()
+		case <-confWriterTimer.C:
+			if !col.cycling {
+				// The timer fired just as the cycle ended.
+				break
+			}
+			log.Warn().Int("dispatched", col.dispatched).Int("probed", col.probed).
+				Msg("cycle timed out, writing partial results...")
+			writeResults(ctx)
+		case res := <-dispatchedChan:
+			done, ok := col.setDispatched(res.cycle, res.count)
+			switch {
+			case !ok:
+				// The cycle timed out before the dispatch completed.
+			case res.count == 0:
+				// Nothing to probe and nothing to write.
+				col.end()
+				confWriterTimer.Stop()
+			default:
+				fetchedRegions = res.regionIDs
+				if done {
+					writeResults(ctx)
 				}
-			}()
+			}
+		case <-written:
+			startupDeadline = nil
+		case err := <-failed:
+			log.Error().Err(err).Int("max-failures", maxFailures).
+				Msg("failed too many times in a row, exiting...")
+			exitCode = CodeTooManyFailures
+			stopping = true
+			updateTimer.Stop()
+			confWriterTimer.Stop()
+			delayedCycle.Stop()
+		case <-startupDeadline:
+			log.Error().Err(fmt.Errorf("no results written before the startup deadline")).
+				Dur("startup-deadline", opts.StartupDeadline).Msg("")
+			exitCode = CodeStartupDeadline
+			stopping = true
+			updateTimer.Stop()
+			confWriterTimer.Stop()
+			delayedCycle.Stop()
+		case name := <-deleted:
+			// Region configmaps are also deleted by the updater itself,
+			// when their region is not in the servers list anymore.
+			wanted := name == defaultConfMapName
+			for _, res := range lastResults {
+				wanted = wanted || regionConfMapName(res.Region.ID) == name
+			}
+
+			switch {
+			case !wanted || lastResults == nil:
+				// Nothing to write yet, or nothing that belongs to it.
+			case col.cycling:
+				log.Info().Str("name", name).
+					Msg("configmap deleted, it will be written at the end of the current cycle")
+			case time.Since(lastRewrite) < minRewriteInterval:
+				// Another controller may be deleting it on purpose: don't
+				// fight it.
+				log.Warn().Str("name", name).Dur("min-rewrite-interval", minRewriteInterval).
+					Msg("configmap deleted again too soon, it will be written at the next cycle")
+			default:
+				log.Info().Str("name", name).Msg("configmap deleted, writing it again...")
+				lastRewrite = time.Now()
+				write(ctx, lastResults, lastRegionIDs, lastStats)
+			}
 		case lat := <-resChan:
-			if lat != nil && len(lat.Servers.WireGuard) > 0 {
-				latResults = append(latResults, lat)
+			if lat == nil {
+				break
+			}
+
+			if col.add(lat) {
+				writeResults(ctx)
 			}
 		case <-stop:
 			stopping = true
-			updateTicker.Stop()
+			updateTimer.Stop()
 			confWriterTimer.Stop()
+			delayedCycle.Stop()
 			fmt.Println()
+
+			// The write must outlive ctx, which is canceled below.
+			if opts.FlushOnShutdown && col.cycling && len(col.results) > 0 {
+				log.Info().Int("servers", len(col.results)).
+					Msg("writing the results of the current cycle before shutting down...")
+				flushCtx, flushCanc := context.WithTimeout(context.Background(), flushTimeout)
+				defer flushCanc()
+				writeResults(flushCtx)
+			}
 		}
 	}
 
-	close(resChan)
-	close(reqChan)
+	// Channels are closed only after all goroutines have exited, as no one
+	// can send on them anymore at that point.
 	canc()
 	log.Info().Msg("shutting down...")
+	if server != nil {
+		shutCtx, shutCanc := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := server.Shutdown(shutCtx); err != nil {
+			log.Err(err).Msg("error while waiting for server to shutdown")
+		}
+		shutCanc()
+	}
 	log.Info().Msg("waiting for all goroutines to exit...")
 
 	wg.Wait()
+	close(reqChan)
+	close(resChan)
 	log.Info().Msg("goodbye!")
+
+	return exitCode
 }
 
-func getKubernetesClientset() (*kubernetes.Clientset, error) {
+func getKubernetesClientset(kubeconfig string) (*kubernetes.Clientset, error) {
+	if kubeconfig != "" {
+		config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+		if err != nil {
+			return nil, fmt.Errorf("could not get configuration from kubeconfig: %w", err)
+		}
+
+		return kubernetes.NewForConfig(config)
+	}
+
 	config, err := rest.InClusterConfig()
 	if err != nil {
 		return nil, fmt.Errorf("could not get configuration from cluster: %w", err)
@@ -297,94 +1182,1031 @@ func getKubernetesClientset() (*kubernetes.Clientset, error) {
 	return kubernetes.NewForConfig(config)
 }
 
-func getServersList(ctx context.Context, serversListURL string) ([]*Region, error) {
-	client := http.Client{}
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, serversListURL, nil)
-	if err != nil {
-		return nil, err
+func getHTTPClient(proxyURL string, timeout time.Duration) (*http.Client, error) {
+	proxy := http.ProxyFromEnvironment
+	if proxyURL != "" {
+		purl, err := url.Parse(proxyURL)
+		if err != nil {
+			return nil, err
+		}
+
+		if purl.Scheme == "" || purl.Host == "" {
+			return nil, fmt.Errorf("proxy url must have a scheme and a host")
+		}
+
+		proxy = http.ProxyURL(purl)
 	}
 
-	resp, err := client.Do(req)
-	if err != nil {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+	}, nil
+}
+
+// getProbeDialer returns the dialer used to measure the latency of servers,
+// going through the SOCKS5 proxy at socks5Addr if not empty. Connections
+// are made from sourceIP, if not nil.
+func getProbeDialer(socks5Addr string, sourceIP net.IP, dialTimeout time.Duration) (proxy.ContextDialer, error) {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	if sourceIP != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: sourceIP}
+	}
+	if socks5Addr == "" {
+		return dialer, nil
+	}
+
+	if _, _, err := net.SplitHostPort(socks5Addr); err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
 
-	var listResp ServersListResponse
-	if err := json.NewDecoder(resp.Body).Decode(&listResp); err != nil {
+	socksDialer, err := proxy.SOCKS5("tcp", socks5Addr, nil, dialer)
+	if err != nil {
 		return nil, err
 	}
 
-	return listResp.Regions, nil
+	return socksDialer.(proxy.ContextDialer), nil
 }
 
-func work(ctx context.Context, reqChan, resChan chan *ServerLatency, log zerolog.Logger, maxLatency time.Duration) {
-	for reg := range reqChan {
-		ip := fmt.Sprintf("%s:443", reg.IP)
-		l := log.With().Str("cn", reg.CN).Str("ip", reg.IP).
-			Logger()
-
-		now := time.Now()
-
-		conn, err := net.DialTimeout("tcp", ip, maxLatency)
-		if err != nil {
-			if err, ok := err.(net.Error); ok && err.Timeout() {
-				l.Debug().Msg("ignoring, as latency is too high")
-			} else {
-				l.Err(err).Msg("error while connecting to server, skipping...")
-			}
+// isLocalIP returns whether ip is assigned to one of the interfaces of the
+// host.
+func isLocalIP(ip net.IP) (bool, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false, err
+	}
 
-			continue
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true, nil
 		}
+	}
 
-		elapsed := time.Since(now)
-		conn.Close()
+	return false, nil
+}
 
-		l.Debug().Str("latency", elapsed.String()).Msg("connected and retrieved latency")
+// getNamespace returns the namespace set in the environment or, if empty,
+// the one of the service account mounted in the pod.
+func getNamespace() (string, error) {
+	if namespace := os.Getenv(namespaceEnv); namespace != "" {
+		return namespace, nil
+	}
 
-		// We use Clone() so that we don't copy pointers.
-		resChan <- &ServerLatency{
-			Latency: &elapsed,
-			Region:  reg.Region.Clone(),
-			Server:  reg.Server.Clone(),
+	data, err := os.ReadFile(namespaceFile)
+	if err != nil {
+		return "", fmt.Errorf("%s is not set and service account namespace could not be read: %w", namespaceEnv, err)
+	}
+
+	namespace := strings.TrimSpace(string(data))
+	if namespace == "" {
+		return "", fmt.Errorf("%s is not set and service account namespace is empty", namespaceEnv)
+	}
+
+	return namespace, nil
+}
+
+// redact hides all but the scheme of an Authorization header value, so that
+// it can be logged.
+func redact(authHeader string) string {
+	if parts := strings.SplitN(authHeader, " ", 2); len(parts) == 2 {
+		return parts[0] + " [REDACTED]"
+	}
+
+	return "[REDACTED]"
+}
+
+// getServersList gets the list of servers from serversListURL, which can
+// also be a file:// URL to read it from disk. If not empty, authHeader and
+// userAgent are sent as the Authorization and User-Agent headers. If
+// signatureKey is not nil, the signature following the list is verified.
+func getServersList(ctx context.Context, client *http.Client, serversListURL, authHeader, userAgent string, signatureKey *rsa.PublicKey) (*ServersListResponse, error) {
+	var body []byte
+	if listURL, err := url.Parse(serversListURL); err == nil && listURL.Scheme == "file" {
+		path, err := filePath(listURL)
+		if err != nil {
+			return nil, &FetchError{Err: err}
+		}
+
+		body, err = os.ReadFile(path)
+		if err != nil {
+			return nil, &FetchError{Err: err}
+		}
+	} else {
+		body, err = downloadServersList(ctx, client, serversListURL, authHeader, userAgent)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	payload, signature := splitServersList(body)
+	if signatureKey != nil {
+		if err := verifySignature(signatureKey, payload, signature); err != nil {
+			return nil, &FetchError{Err: err}
+		}
+	}
+
+	var listResp ServersListResponse
+	if err := json.Unmarshal(payload, &listResp); err != nil {
+		return nil, &DecodeError{Err: err}
+	}
+
+	if len(listResp.Regions) == 0 {
+		return nil, &DecodeError{Err: fmt.Errorf("no regions found in response")}
+	}
+
+	return &listResp, nil
+}
+
+// filePath returns the path of the file:// URL fileURL. Only absolute paths
+// on the local host are supported: file://data/servers.json would read
+// /servers.json from a host called data.
+func filePath(fileURL *url.URL) (string, error) {
+	if fileURL.Host != "" && fileURL.Host != "localhost" {
+		return "", fmt.Errorf("file url must have an absolute path and no host, e.g. file:///data/servers.json, got host %q", fileURL.Host)
+	}
+
+	return fileURL.Path, nil
+}
+
+func downloadServersList(ctx context.Context, client *http.Client, serversListURL, authHeader, userAgent string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, serversListURL, nil)
+	if err != nil {
+		return nil, &FetchError{Err: err}
+	}
+
+	if authHeader != "" {
+		req.Header.Set("Authorization", authHeader)
+	}
+	if userAgent != "" {
+		req.Header.Set("User-Agent", userAgent)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			return nil, &FetchError{Err: fmt.Errorf("timed out while connecting: %w", err)}
+		}
+
+		return nil, &FetchError{Err: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &FetchError{Err: &StatusError{StatusCode: resp.StatusCode}}
+	}
+
+	// An HTML page is what captive portals and error pages usually return,
+	// while the list itself is not always served as application/json.
+	if ctype := resp.Header.Get("Content-Type"); strings.HasPrefix(ctype, "text/html") {
+		return nil, &FetchError{Err: fmt.Errorf("unexpected content type %s", ctype)}
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			return nil, &FetchError{Err: fmt.Errorf("timed out while reading response: %w", err)}
+		}
+
+		return nil, &FetchError{Err: err}
+	}
+
+	return body, nil
+}
+
+// filterRegions returns the regions whose ID is in the comma separated ids,
+// or all of them if ids is empty.
+func filterRegions(regions []*Region, ids string) []*Region {
+	if strings.TrimSpace(ids) == "" {
+		return regions
+	}
+
+	wanted := map[string]bool{}
+	for _, id := range strings.Split(ids, ",") {
+		wanted[strings.TrimSpace(id)] = true
+	}
+
+	filtered := []*Region{}
+	for _, region := range regions {
+		if wanted[region.ID] {
+			filtered = append(filtered, region)
+		}
+	}
+
+	return filtered
+}
+
+// filterVAN returns regions with only the WireGuard servers that can be
+// probed according to mode, as told by isVANAllowed. The regions are copied
+// if any of their servers is left out.
+func filterVAN(regions []*Region, mode string) []*Region {
+	filtered := make([]*Region, 0, len(regions))
+	for _, region := range regions {
+		if region.Servers == nil {
+			filtered = append(filtered, region)
+			continue
+		}
+
+		servers := []*Server{}
+		for _, serv := range region.Servers.WireGuard {
+			if isVANAllowed(serv.VAN, mode) {
+				servers = append(servers, serv)
+			}
+		}
+		if len(servers) == len(region.Servers.WireGuard) {
+			filtered = append(filtered, region)
+			continue
+		}
+
+		reg, list := *region, *region.Servers
+		list.WireGuard = servers
+		reg.Servers = &list
+		filtered = append(filtered, &reg)
+	}
+
+	return filtered
+}
+
+// newJitter returns a function that returns a random delay lower than
+// maxJitter, or always 0 if maxJitter is 0. The delays only depend on seed,
+// unless it is 0 and the current time is used instead.
+func newJitter(maxJitter time.Duration, seed int64) func() time.Duration {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	rng := rand.New(rand.NewSource(seed))
+
+	return func() time.Duration {
+		if maxJitter == 0 {
+			return 0
 		}
+
+		return time.Duration(rng.Int63n(int64(maxJitter)))
 	}
 }
 
-func updateConfigMap(ctx context.Context, clientset *kubernetes.Clientset, namespace string, latencies []*ServerLatency) error {
+// dispatch sends all the WireGuard servers of regions to reqChan, tagged
+// with cycle, and returns how many were sent. If maxRegions is not 0, the
+// servers of a region are only sent once all the ones of the regions in
+// flight are probed, so that at most maxRegions regions are probed at the
+// same time.
+func dispatch(ctx context.Context, reqChan chan<- *ServerLatency, regions []*Region, port uint16, maxRegions uint, cycle uint64) (int, error) {
+	var sem chan struct{}
+	if maxRegions > 0 {
+		sem = make(chan struct{}, maxRegions)
+	}
+
+	count := 0
+	for _, region := range regions {
+		// TODO: we're only concentrating on WireGuard for now. So we skip
+		// this if it doesn't have any.
+		if region.Servers == nil || len(region.Servers.WireGuard) == 0 {
+			continue
+		}
+
+		// Workers tell when they are done with a server through probed,
+		// which has room for all of them so that they never block.
+		var probed chan struct{}
+		if sem != nil {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return count, ctx.Err()
+			}
+
+			probed = make(chan struct{}, len(region.Servers.WireGuard))
+		}
+
+		for _, serv := range region.Servers.WireGuard {
+			req := &ServerLatency{
+				Server: serv,
+				Region: region,
+				port:   port,
+				cycle:  cycle,
+			}
+			if sem != nil {
+				req.done = func() { probed <- struct{}{} }
+			}
+
+			select {
+			case reqChan <- req:
+				count++
+			case <-ctx.Done():
+				return count, ctx.Err()
+			}
+		}
+
+		// The region leaves room for the next one once all its servers are
+		// probed. Servers still queued when ctx is done never are.
+		if sem != nil {
+			go func(sent int) {
+				for i := 0; i < sent; i++ {
+					select {
+					case <-probed:
+					case <-ctx.Done():
+						return
+					}
+				}
+				<-sem
+			}(len(region.Servers.WireGuard))
+		}
+	}
+
+	return count, nil
+}
+
+// startWorkers starts opts.Workers workers, or defaultWorkersNumber if it
+// is 0, and returns how many were started. wg is done once they all exit.
+func startWorkers(ctx context.Context, wg *sync.WaitGroup, dialer proxy.ContextDialer, reqChan, resChan chan *ServerLatency, log zerolog.Logger, opts *Options) int {
+	workers := int(opts.Workers)
+	if workers == 0 {
+		log.Debug().Uint("workers", opts.Workers).
+			Uint("default-workers-number", defaultWorkersNumber).
+			Msg("invalid workers flag provided: using default value...")
+		workers = int(defaultWorkersNumber)
+	}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(wid int) {
+			defer wg.Done()
+
+			log.Info().Int("worker", wid+1).Msg("worker starting...")
+			work(ctx, dialer, reqChan, resChan, log, opts)
+			log.Info().Int("worker", wid+1).Msg("worker exited")
+		}(i)
+	}
+
+	return workers
+}
+
+// work probes the servers received from reqChan and sends the results to
+// resChan, until ctx is done or reqChan is closed. Servers are queued one by
+// one regardless of their region, so --workers is a global cap on the
+// number of servers probed at the same time: the results are only grouped
+// by region when written.
+func work(ctx context.Context, dialer proxy.ContextDialer, reqChan, resChan chan *ServerLatency, log zerolog.Logger, opts *Options) {
+	for {
+		var reg *ServerLatency
+		select {
+		case <-ctx.Done():
+			return
+		case r, ok := <-reqChan:
+			if !ok {
+				return
+			}
+			reg = r
+		}
+
+		res := probe(ctx, dialer, reg, log, opts)
+		if reg.done != nil {
+			reg.done()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		// A result is sent even if the latency could not be measured, so
+		// that the main loop knows when all servers have been probed.
+		select {
+		case resChan <- res:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// probe measures the latency of the server in reg and returns a copy of it
+// with the Latency field set, or left nil if it could not be measured.
+func probe(ctx context.Context, dialer proxy.ContextDialer, reg *ServerLatency, log zerolog.Logger, opts *Options) *ServerLatency {
+	// We use Clone() so that we don't copy pointers.
+	res := &ServerLatency{
+		Region: reg.Region.Clone(),
+		Server: reg.Server.Clone(),
+		cycle:  reg.cycle,
+	}
+
+	target := reg.IP
+	if strings.EqualFold(opts.ProbeTarget, probeTargetCN) {
+		target = reg.CN
+	}
+	addr := net.JoinHostPort(target, strconv.Itoa(int(reg.port)))
+	l := log.With().Str("cn", reg.CN).Str("ip", reg.IP).
+		Logger()
+
+	if !isIPFamily(reg.IP, opts.IPFamily) {
+		l.Debug().Msg("ignoring, as ip family does not match")
+		return res
+	}
+
+	// ICMP is only used for IPv4 servers.
+	useICMP := strings.EqualFold(opts.ProbeMethod, probeMethodICMP) &&
+		net.ParseIP(reg.IP).To4() != nil
+
+	useTLS := strings.EqualFold(opts.ProbeMethod, probeMethodTLS)
+
+	// The first connection to a server is often slower, as routes and
+	// caches are not set up yet: its result is discarded.
+	if opts.Warmup {
+		if useICMP {
+			ping(ctx, opts.SourceIP, reg.IP, opts.DialTimeout)
+		} else {
+			dialCtx, dialCanc := context.WithTimeout(ctx, opts.DialTimeout)
+			if conn, err := dialer.DialContext(dialCtx, "tcp", addr); err == nil {
+				conn.Close()
+			}
+			dialCanc()
+		}
+	}
+
+	samples := make([]time.Duration, 0, opts.Samples)
+	var err error
+	for i := 0; i < int(opts.Samples) && err == nil; i++ {
+		// Every dial uses a new socket, and so a new local port, but
+		// samples taken back to back may still be affected by the state
+		// the previous connection left on both ends, e.g. SYN cookies.
+		if i > 0 && opts.SampleInterval > 0 {
+			select {
+			case <-time.After(opts.SampleInterval):
+			case <-ctx.Done():
+				return res
+			}
+		}
+
+		if useICMP {
+			var rtt time.Duration
+			if rtt, err = ping(ctx, opts.SourceIP, reg.IP, opts.DialTimeout); err == nil {
+				samples = append(samples, rtt)
+			}
+			continue
+		}
+
+		var conn net.Conn
+		now := time.Now()
+
+		// The SOCKS5 dialer only uses the dialer timeout to connect to the
+		// proxy, so the timeout is enforced on the whole dial here.
+		dialCtx, dialCanc := context.WithTimeout(ctx, opts.DialTimeout)
+		conn, err = dialer.DialContext(dialCtx, "tcp", addr)
+		if err == nil && useTLS {
+			conn, err = tlsHandshake(dialCtx, conn, reg.CN, opts.tlsRootCAs, opts.TLSInsecureSkipVerify)
+		}
+		dialCanc()
+		if err == nil {
+			samples = append(samples, time.Since(now))
+			conn.Close()
+		}
+	}
+
+	if err != nil {
+		if ctx.Err() != nil {
+			return res
+		}
+
+		// The server can be reached, but it may not be the one it claims
+		// to be: it is not marked as degraded, as it must not be used.
+		if isCertificateError(err) {
+			l.Warn().Err(err).Msg("ignoring, as server certificate could not be verified")
+			return res
+		}
+
+		// The server may be fine, it is its name that could not be
+		// resolved: it is not marked as degraded.
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) {
+			l.Warn().Err(err).Msg("ignoring, as server name could not be resolved")
+			return res
+		}
+
+		if err, ok := err.(net.Error); (ok && err.Timeout()) || opts.SOCKS5 != "" {
+			l.Debug().Msg("ignoring, as server could not be reached in time")
+		} else {
+			perr := &ProbeError{Address: addr, Err: err}
+			l.Err(perr).Bool("transient", perr.IsTransient()).
+				Msg("error while connecting to server, skipping...")
+		}
+
+		res.Degraded = true
+		return res
+	}
+
+	// Use the median, so that a single slow sample does not count
+	// too much.
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i] < samples[j]
+	})
+	elapsed := Duration(samples[len(samples)/2])
+	res.Latency = &elapsed
+	res.LastProbed = time.Now()
+	if len(samples) > 1 {
+		jitter := Duration(samples[len(samples)-1] - samples[0])
+		res.Jitter = &jitter
+	}
+
+	if opts.CheckDNS {
+		healthy := checkDNS(ctx, reg.DNS)
+		res.Region.Healthy = &healthy
+		if !healthy {
+			l.Warn().Str("dns", reg.DNS).Msg("could not resolve region dns name")
+		}
+	}
+
+	l.Debug().Str("latency", elapsed.String()).Msg("connected and retrieved latency")
+	return res
+}
+
+// checkDNS returns whether the DNS name of a region can be resolved to at
+// least one address.
+func checkDNS(ctx context.Context, name string) bool {
+	if name == "" {
+		return false
+	}
+
+	dnsCtx, canc := context.WithTimeout(ctx, dnsTimeout)
+	defer canc()
+
+	addrs, err := net.DefaultResolver.LookupHost(dnsCtx, name)
+	return err == nil && len(addrs) > 0
+}
+
+// isIPFamily returns whether ip belongs to the provided family, which is
+// one of ipFamily4, ipFamily6 or ipFamilyAny.
+func isIPFamily(ip, family string) bool {
+	if strings.EqualFold(family, ipFamilyAny) {
+		return true
+	}
+
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+
+	if family == ipFamily4 {
+		return parsed.To4() != nil
+	}
+
+	return parsed.To4() == nil
+}
+
+// isVANAllowed returns whether a server with the provided VAN flag can be
+// probed according to mode, which is one of vanInclude, vanExclude or
+// vanOnly.
+func isVANAllowed(van bool, mode string) bool {
+	switch {
+	case strings.EqualFold(mode, vanExclude):
+		return !van
+	case strings.EqualFold(mode, vanOnly):
+		return van
+	default:
+		return true
+	}
+}
+
+// dropSlow marks res as degraded, without a latency, if its latency is
+// greater than maxLatency.
+func dropSlow(res *ServerLatency, maxLatency time.Duration) {
+	if res.Latency == nil || time.Duration(*res.Latency) <= maxLatency {
+		return
+	}
+
+	res.Latency = nil
+	res.Degraded = true
+}
+
+// watchDeletions sends to deleted the name of every configmap matching
+// listOpts that is deleted, until ctx is done. The watch is started again
+// whenever it ends.
+func watchDeletions(ctx context.Context, clientset kubernetes.Interface, namespace string, listOpts metav1.ListOptions, deleted chan<- string, log zerolog.Logger) {
 	cfg := clientset.CoreV1().ConfigMaps(namespace)
-	exists := true
-	confMap, err := cfg.Get(ctx, defaultConfMapName, metav1.GetOptions{})
+	for {
+		w, err := cfg.Watch(ctx, listOpts)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			log.Err(err).Msg("could not watch configmaps, retrying...")
+			select {
+			case <-time.After(watchRetryInterval):
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		for ev := range w.ResultChan() {
+			if ev.Type != watch.Deleted {
+				continue
+			}
+
+			if confMap, ok := ev.Object.(*corev1.ConfigMap); ok {
+				select {
+				case deleted <- confMap.Name:
+				case <-ctx.Done():
+				}
+			}
+		}
+		w.Stop()
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// regionConfMapName returns the name of the configmap of a region, as
+// region IDs may contain characters that are not valid in a name.
+func regionConfMapName(id string) string {
+	return regionConfMapPrefix + strings.ReplaceAll(strings.ToLower(id), "_", "-")
+}
+
+// hasWrittenData returns whether the configmaps of outputMode have already
+// been written, by this process or a previous one.
+func hasWrittenData(ctx context.Context, clientset kubernetes.Interface, namespace, outputMode string) (bool, error) {
+	cfg := clientset.CoreV1().ConfigMaps(namespace)
+	if strings.EqualFold(outputMode, outputModeSplit) {
+		list, err := cfg.List(ctx, metav1.ListOptions{LabelSelector: regionsLabel})
+		if err != nil {
+			return false, err
+		}
 
+		return len(list.Items) > 0, nil
+	}
+
+	confMap, err := cfg.Get(ctx, defaultConfMapName, metav1.GetOptions{})
 	if err != nil {
-		if !kerr.IsNotFound(err) {
+		if kerr.IsNotFound(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return len(confMap.BinaryData["regions"]) > 0, nil
+}
+
+// updateRegionConfigMaps writes the latencies of each region to a separate
+// configmap, all labeled with regionsLabel. The configmaps of regions that
+// are not in fetched, i.e. that are not in the servers list anymore, are
+// deleted. Nothing is deleted if fetched is nil.
+func updateRegionConfigMaps(ctx context.Context, clientset kubernetes.Interface, namespace, format, strategy string, compress bool, latencies []*ServerLatency, fetched map[string]bool, stats cycleStats) error {
+	byRegion := map[string][]*ServerLatency{}
+	ids := []string{}
+	for _, lat := range latencies {
+		if _, exists := byRegion[lat.Region.ID]; !exists {
+			ids = append(ids, lat.Region.ID)
+		}
+		byRegion[lat.Region.ID] = append(byRegion[lat.Region.ID], lat)
+	}
+
+	for _, id := range ids {
+		labels := map[string]string{
+			regionsLabel: defaultConfMapName,
+			regionLabel:  id,
+		}
+		if err := updateConfigMap(ctx, clientset, namespace, regionConfMapName(id), labels, format, strategy, compress, configMapData{Regions: byRegion[id]}, stats); err != nil {
 			return err
 		}
+	}
+
+	if fetched == nil {
+		return nil
+	}
+
+	cfg := clientset.CoreV1().ConfigMaps(namespace)
+	list, err := cfg.List(ctx, metav1.ListOptions{LabelSelector: regionsLabel})
+	if err != nil {
+		return &WriteError{Err: err}
+	}
+
+	// Regions that are still listed are kept even if none of their servers
+	// was kept in this cycle.
+	for _, confMap := range list.Items {
+		if fetched[confMap.Labels[regionLabel]] {
+			continue
+		}
+
+		err := cfg.Delete(ctx, confMap.Name, metav1.DeleteOptions{})
+		if err != nil && !kerr.IsNotFound(err) {
+			return &WriteError{Err: err}
+		}
+	}
+
+	return nil
+}
+
+// dispatchResult is what is known about a cycle once all of its servers
+// are dispatched.
+type dispatchResult struct {
+	cycle     uint64
+	count     int
+	regionIDs map[string]bool
+}
+
+// configMapData is the data written to the configmap, each field under its
+// own key. Keys of nil fields are removed from the configmap.
+type configMapData struct {
+	Regions   []*ServerLatency
+	Best      map[string]*Server
+	Countries map[string][]*Region
+}
+
+// cycleStats are statistics about an update cycle.
+type cycleStats struct {
+	RegionsProbed int
+	ServersKept   int
+	Duration      time.Duration
+}
+
+// gzipData returns data compressed with gzip.
+func gzipData(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// marshalConfigMapData returns the data to write under each key of the
+// configmap, along with its hash. Keys whose data is nil must be removed.
+// The hash covers all the data, latencies included, so that the configmap
+// is never left with stale measurements.
+func marshalConfigMapData(format string, cmData configMapData) (map[string][]byte, string, error) {
+	marshal := yaml.Marshal
+	if strings.EqualFold(format, formatJSON) {
+		marshal = json.Marshal
+	}
+
+	// Keys are marshalled in a fixed order, so that the hash does not
+	// change if the data does not.
+	keys := []string{"regions", "best", "countries"}
+	values := map[string]interface{}{
+		"regions": cmData.Regions,
+	}
+	if cmData.Best != nil {
+		values["best"] = cmData.Best
+	}
+	if cmData.Countries != nil {
+		values["countries"] = cmData.Countries
+	}
+
+	data := map[string][]byte{}
+	hasher := sha256.New()
+	for _, key := range keys {
+		val, exists := values[key]
+		if !exists {
+			data[key] = nil
+			continue
+		}
+
+		marshalled, err := marshal(val)
+		if err != nil {
+			return nil, "", err
+		}
+		data[key] = marshalled
+		hasher.Write(marshalled)
+	}
+
+	return data, fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
+
+// fitConfigMapData drops the slowest servers of cmData, whatever the order
+// they are written in, until its data takes at most maxBytes, once
+// compressed if compress is true. Degraded servers, which have no latency,
+// are dropped first. The best servers and the countries are computed again
+// from the servers that are kept. It returns the data along with the number
+// of servers dropped, or an error if not even one server fits.
+func fitConfigMapData(format string, compress bool, cmData configMapData, maxBytes uint) (configMapData, int, error) {
+	// Indexes of the servers from the fastest to the slowest.
+	bySpeed := make([]int, len(cmData.Regions))
+	for i := range bySpeed {
+		bySpeed[i] = i
+	}
+	sort.SliceStable(bySpeed, func(i, j int) bool {
+		ilat, jlat := cmData.Regions[bySpeed[i]].Latency, cmData.Regions[bySpeed[j]].Latency
+		if ilat == nil || jlat == nil {
+			return jlat == nil && ilat != nil
+		}
+
+		return *ilat < *jlat
+	})
+
+	// fit returns the data with only the n fastest servers, in their
+	// original order.
+	fit := func(n int) configMapData {
+		keep := make([]bool, len(cmData.Regions))
+		for _, i := range bySpeed[:n] {
+			keep[i] = true
+		}
+
+		fitted := cmData
+		fitted.Regions = make([]*ServerLatency, 0, n)
+		for i, res := range cmData.Regions {
+			if keep[i] {
+				fitted.Regions = append(fitted.Regions, res)
+			}
+		}
+		if cmData.Best != nil {
+			fitted.Best = map[string]*Server{}
+			for id, res := range bestPerRegion(fitted.Regions) {
+				fitted.Best[id] = res.Server
+			}
+		}
+		if cmData.Countries != nil {
+			fitted.Countries = groupByCountry(fitted.Regions)
+		}
 
-		exists = false
-		confMap = &corev1.ConfigMap{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:        defaultConfMapName,
-				Namespace:   namespace,
-				Annotations: map[string]string{},
-			},
-			BinaryData: map[string][]byte{},
+		return fitted
+	}
+
+	var marshalErr error
+	size := func(n int) int {
+		data, _, err := marshalConfigMapData(format, fit(n))
+		if err != nil {
+			marshalErr = err
+			return 0
 		}
+
+		total := 0
+		for _, val := range data {
+			if compress && val != nil {
+				if val, err = gzipData(val); err != nil {
+					marshalErr = err
+					return 0
+				}
+			}
+			total += len(val)
+		}
+		return total
+	}
+
+	if size(len(cmData.Regions)) <= int(maxBytes) {
+		return cmData, 0, marshalErr
+	}
+
+	// The size only grows with the number of servers, so look for the
+	// largest number of them that still fits.
+	kept := sort.Search(len(cmData.Regions)+1, func(n int) bool {
+		return size(n) > int(maxBytes)
+	}) - 1
+	if marshalErr != nil {
+		return cmData, 0, marshalErr
 	}
+	if kept <= 0 {
+		return cmData, 0, fmt.Errorf("not even a single server fits in %d bytes", maxBytes)
+	}
+
+	return fit(kept), len(cmData.Regions) - kept, nil
+}
 
-	data, err := yaml.Marshal(latencies)
+// updateConfigMap writes latencies to the configmap called name, creating it
+// with labels if it does not exist, along with the stats of the cycle that
+// produced them. Existing configmaps are either replaced or patched,
+// depending on strategy. The data is compressed with gzip if compress is
+// true. Conflicting writes are retried with the latest version of the
+// configmap, until ctx expires.
+func updateConfigMap(ctx context.Context, clientset kubernetes.Interface, namespace, name string, labels map[string]string, format, strategy string, compress bool, cmData configMapData, stats cycleStats) error {
+	data, hash, err := marshalConfigMapData(format, cmData)
 	if err != nil {
-		return err
+		return &WriteError{Err: err}
 	}
 
-	confMap.BinaryData["regions"] = data
-	confMap.Annotations["last-update"] = time.Now().String()
+	// The hash is computed on the uncompressed data, so that it does not
+	// depend on the compression.
+	if compress {
+		for key, val := range data {
+			if val == nil {
+				continue
+			}
 
-	if exists {
-		_, err = cfg.Update(ctx, confMap, metav1.UpdateOptions{})
-	} else {
-		_, err = cfg.Create(ctx, confMap, metav1.CreateOptions{})
+			if data[key], err = gzipData(val); err != nil {
+				return &WriteError{Err: err}
+			}
+		}
+	}
+
+	cfg := clientset.CoreV1().ConfigMaps(namespace)
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		exists := true
+		confMap, err := cfg.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			if !kerr.IsNotFound(err) {
+				return err
+			}
+
+			exists = false
+			confMap = &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        name,
+					Namespace:   namespace,
+					Labels:      labels,
+					Annotations: map[string]string{},
+				},
+				BinaryData: map[string][]byte{},
+			}
+		}
+
+		// The existing ConfigMap may have been created or edited by someone
+		// else, so don't assume its maps are initialized.
+		if confMap.BinaryData == nil {
+			confMap.BinaryData = map[string][]byte{}
+		}
+		if confMap.Annotations == nil {
+			confMap.Annotations = map[string]string{}
+		}
+
+		// Don't write the same data again, as consumers mounting the
+		// configmap would see it as a change.
+		if exists && confMap.Annotations[contentHashAnnotation] == hash &&
+			(confMap.Annotations[encodingAnnotation] == encodingGzip) == compress {
+			return nil
+		}
+
+		annotations := map[string]string{
+			"last-update":           time.Now().String(),
+			contentHashAnnotation:   hash,
+			regionsProbedAnnotation: strconv.Itoa(stats.RegionsProbed),
+			serversKeptAnnotation:   strconv.Itoa(stats.ServersKept),
+			cycleDurationAnnotation: stats.Duration.Round(time.Millisecond).String(),
+		}
+
+		// A merge patch only touches our keys, leaving the ones written by
+		// others intact. Keys set to null are removed.
+		if exists && strings.EqualFold(strategy, updateStrategyPatch) {
+			patchAnnotations := map[string]interface{}{
+				encodingAnnotation: nil,
+			}
+			for key, val := range annotations {
+				patchAnnotations[key] = val
+			}
+			if compress {
+				patchAnnotations[encodingAnnotation] = encodingGzip
+			}
+
+			// Null labels would remove all of them.
+			metadata := map[string]interface{}{
+				"annotations": patchAnnotations,
+			}
+			if len(labels) > 0 {
+				metadata["labels"] = labels
+			}
+
+			patch, err := json.Marshal(map[string]interface{}{
+				"metadata":   metadata,
+				"binaryData": data,
+			})
+			if err != nil {
+				return err
+			}
+
+			_, err = cfg.Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{})
+			return err
+		}
+
+		for key, val := range data {
+			if val == nil {
+				delete(confMap.BinaryData, key)
+				continue
+			}
+
+			confMap.BinaryData[key] = val
+		}
+		for key, val := range annotations {
+			confMap.Annotations[key] = val
+		}
+		if compress {
+			confMap.Annotations[encodingAnnotation] = encodingGzip
+		} else {
+			delete(confMap.Annotations, encodingAnnotation)
+		}
+		if len(labels) > 0 && confMap.Labels == nil {
+			confMap.Labels = map[string]string{}
+		}
+		for key, val := range labels {
+			confMap.Labels[key] = val
+		}
+
+		if exists {
+			_, err = cfg.Update(ctx, confMap, metav1.UpdateOptions{})
+		} else {
+			_, err = cfg.Create(ctx, confMap, metav1.CreateOptions{})
+		}
+
+		return err
+	})
+	if err != nil {
+		return &WriteError{Err: err}
 	}
 
-	return err
+	return nil
 }
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testNamespace = "pia"
+
+func TestUpdateConfigMapNilMaps(t *testing.T) {
+	for _, strategy := range []string{updateStrategyReplace, updateStrategyPatch} {
+		t.Run(strategy, func(t *testing.T) {
+			// Created by someone else, without annotations nor data.
+			clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      defaultConfMapName,
+					Namespace: testNamespace,
+					Labels:    map[string]string{"app": "pia"},
+				},
+			})
+
+			ctx := context.Background()
+			cmData := configMapData{
+				Regions: []*ServerLatency{newTestResult(0, "r1", "10.0.0.1", time.Millisecond)},
+			}
+			if err := updateConfigMap(ctx, clientset, testNamespace, defaultConfMapName, nil, formatJSON, strategy, false, cmData, cycleStats{}); err != nil {
+				t.Fatalf("could not update configmap: %v", err)
+			}
+
+			confMap, err := clientset.CoreV1().ConfigMaps(testNamespace).Get(ctx, defaultConfMapName, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("could not get configmap: %v", err)
+			}
+			if len(confMap.BinaryData["regions"]) == 0 {
+				t.Error("regions not written")
+			}
+			if confMap.Annotations[contentHashAnnotation] == "" {
+				t.Error("content hash not written")
+			}
+			if confMap.Labels["app"] != "pia" {
+				t.Errorf("labels not preserved, got %v", confMap.Labels)
+			}
+		})
+	}
+}
+
+func newTestRegions(regions, servers int) []*Region {
+	list := []*Region{}
+	for i := 0; i < regions; i++ {
+		reg := &Region{ID: fmt.Sprintf("r%d", i), Servers: &ServersList{}}
+		for j := 0; j < servers; j++ {
+			reg.Servers.WireGuard = append(reg.Servers.WireGuard, &Server{IP: fmt.Sprintf("10.0.%d.%d", i, j)})
+		}
+		list = append(list, reg)
+	}
+
+	return list
+}
+
+func TestDispatchCanceled(t *testing.T) {
+	for _, maxRegions := range []uint{0, 1} {
+		t.Run(fmt.Sprintf("max-regions=%d", maxRegions), func(t *testing.T) {
+			ctx, canc := context.WithCancel(context.Background())
+			defer canc()
+
+			// No buffer and a single worker that stops after a few servers,
+			// as if it was shut down.
+			reqChan := make(chan *ServerLatency)
+			go func() {
+				for i := 0; i < 3; i++ {
+					req := <-reqChan
+					if req.done != nil {
+						req.done()
+					}
+				}
+				canc()
+			}()
+
+			type result struct {
+				count int
+				err   error
+			}
+			done := make(chan result, 1)
+			go func() {
+				count, err := dispatch(ctx, reqChan, newTestRegions(4, 2), 1337, maxRegions, 1)
+				done <- result{count, err}
+			}()
+
+			select {
+			case res := <-done:
+				if !errors.Is(res.err, context.Canceled) {
+					t.Errorf("got error %v, want %v", res.err, context.Canceled)
+				}
+				if res.count != 3 {
+					t.Errorf("got %d servers dispatched, want 3", res.count)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("dispatch did not return after being canceled")
+			}
+		})
+	}
+}
+
+// pipeDialer connects to an in-memory server after a short random delay.
+type pipeDialer struct{}
+
+func (pipeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	select {
+	case <-time.After(time.Duration(rand.Intn(500)) * time.Microsecond):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	client, server := net.Pipe()
+	server.Close()
+	return client, nil
+}
+
+// TestShutdownStress shuts down in the same order as run, while dispatch and
+// the workers are busy, to be run with -race.
+func TestShutdownStress(t *testing.T) {
+	opts := &Options{
+		Samples:     1,
+		DialTimeout: time.Second,
+		IPFamily:    ipFamilyAny,
+	}
+
+	for i := 0; i < 50; i++ {
+		ctx, canc := context.WithCancel(context.Background())
+		reqChan := make(chan *ServerLatency, 4)
+		resChan := make(chan *ServerLatency, 4)
+
+		wg := sync.WaitGroup{}
+		for w := 0; w < 8; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				work(ctx, pipeDialer{}, reqChan, resChan, zerolog.Nop(), opts)
+			}()
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dispatch(ctx, reqChan, newTestRegions(20, 5), 1337, 2, 1)
+		}()
+
+		// The main loop stops reading results as soon as it is stopping.
+		stopping := make(chan struct{})
+		consumed := make(chan struct{})
+		go func() {
+			defer close(consumed)
+			for {
+				select {
+				case <-resChan:
+				case <-stopping:
+					return
+				}
+			}
+		}()
+
+		time.Sleep(time.Duration(rand.Intn(5)) * time.Millisecond)
+		close(stopping)
+		<-consumed
+
+		canc()
+		wg.Wait()
+		close(reqChan)
+		close(resChan)
+	}
+}
+
+func TestFilterVAN(t *testing.T) {
+	regions := []*Region{
+		{ID: "mixed", Servers: &ServersList{WireGuard: []*Server{
+			{IP: "10.0.0.1", VAN: false},
+			{IP: "10.0.0.2", VAN: true},
+		}}},
+		{ID: "van", Servers: &ServersList{WireGuard: []*Server{
+			{IP: "10.0.1.1", VAN: true},
+		}}},
+		{ID: "plain", Servers: &ServersList{WireGuard: []*Server{
+			{IP: "10.0.2.1", VAN: false},
+		}}},
+	}
+
+	tests := []struct {
+		mode string
+		want []string
+	}{
+		{mode: vanInclude, want: []string{"10.0.0.1", "10.0.0.2", "10.0.1.1", "10.0.2.1"}},
+		{mode: vanExclude, want: []string{"10.0.0.1", "10.0.2.1"}},
+		{mode: vanOnly, want: []string{"10.0.0.2", "10.0.1.1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			// Servers left out are not even dispatched.
+			reqChan := make(chan *ServerLatency, 10)
+			count, err := dispatch(context.Background(), reqChan, filterVAN(regions, tt.mode), 1337, 0, 1)
+			if err != nil {
+				t.Fatalf("could not dispatch: %v", err)
+			}
+			close(reqChan)
+
+			got := []string{}
+			for req := range reqChan {
+				got = append(got, req.IP)
+			}
+			if count != len(tt.want) || fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("got %v dispatched, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// The servers list itself is left untouched.
+	if len(regions[0].Servers.WireGuard) != 2 {
+		t.Error("servers removed from the original region")
+	}
+}
+
+func TestStartWorkers(t *testing.T) {
+	for _, workers := range []uint{0, 1, 3} {
+		t.Run(fmt.Sprintf("workers=%d", workers), func(t *testing.T) {
+			ctx, canc := context.WithCancel(context.Background())
+			reqChan := make(chan *ServerLatency)
+			resChan := make(chan *ServerLatency)
+			opts := &Options{
+				Workers:     workers,
+				Samples:     1,
+				DialTimeout: time.Second,
+				IPFamily:    ipFamilyAny,
+			}
+
+			wg := sync.WaitGroup{}
+			started := startWorkers(ctx, &wg, pipeDialer{}, reqChan, resChan, zerolog.Nop(), opts)
+
+			// A server is only probed if a worker is running.
+			region := newTestRegions(1, 1)[0]
+			req := &ServerLatency{Server: region.Servers.WireGuard[0], Region: region, port: 1337}
+			select {
+			case reqChan <- req:
+			case <-time.After(5 * time.Second):
+				t.Fatal("server not dispatched")
+			}
+			select {
+			case <-resChan:
+			case <-time.After(5 * time.Second):
+				t.Fatal("server not probed")
+			}
+			canc()
+			wg.Wait()
+
+			want := int(workers)
+			if workers == 0 {
+				want = int(defaultWorkersNumber)
+			}
+			if started != want {
+				t.Errorf("got %d workers started, want %d", started, want)
+			}
+		})
+	}
+}
+
+func TestUpdateRegionConfigMapsRemovesRegions(t *testing.T) {
+	ctx := context.Background()
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "unrelated", Namespace: testNamespace},
+	})
+
+	cycle := func(fetched ...string) {
+		regionIDs := map[string]bool{}
+		results := []*ServerLatency{}
+		for i, id := range fetched {
+			regionIDs[id] = true
+			results = append(results, newTestResult(0, id, fmt.Sprintf("10.0.%d.1", i), time.Millisecond))
+		}
+
+		if err := updateRegionConfigMaps(ctx, clientset, testNamespace, formatYAML, updateStrategyReplace, false, results, regionIDs, cycleStats{}); err != nil {
+			t.Fatalf("could not update configmaps: %v", err)
+		}
+	}
+
+	names := func() []string {
+		list, err := clientset.CoreV1().ConfigMaps(testNamespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			t.Fatalf("could not list configmaps: %v", err)
+		}
+
+		names := []string{}
+		for _, confMap := range list.Items {
+			names = append(names, confMap.Name)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	cycle("r1", "r2")
+	want := fmt.Sprint([]string{regionConfMapName("r1"), regionConfMapName("r2"), "unrelated"})
+	if got := fmt.Sprint(names()); got != want {
+		t.Fatalf("got configmaps %s, want %s", got, want)
+	}
+
+	// r2 is not in the servers list anymore.
+	cycle("r1")
+	want = fmt.Sprint([]string{regionConfMapName("r1"), "unrelated"})
+	if got := fmt.Sprint(names()); got != want {
+		t.Fatalf("got configmaps %s, want %s", got, want)
+	}
+
+	// Nothing is deleted if the servers list could not be loaded.
+	if err := updateRegionConfigMaps(ctx, clientset, testNamespace, formatYAML, updateStrategyReplace, false, nil, nil, cycleStats{}); err != nil {
+		t.Fatalf("could not update configmaps: %v", err)
+	}
+	if got := fmt.Sprint(names()); got != want {
+		t.Fatalf("got configmaps %s, want %s", got, want)
+	}
+}
+
+func TestFitConfigMapData(t *testing.T) {
+	// Sorted by name, the slowest server comes first.
+	slow := newTestResult(0, "a", "10.0.0.1", 40*time.Millisecond)
+	fast := newTestResult(0, "b", "10.0.1.1", 10*time.Millisecond)
+	cmData := configMapData{
+		Regions: []*ServerLatency{slow, fast},
+		Best: map[string]*Server{
+			"a": slow.Server,
+			"b": fast.Server,
+		},
+	}
+
+	// Just enough room for the fastest server.
+	data, _, err := marshalConfigMapData(formatJSON, configMapData{
+		Regions: []*ServerLatency{fast},
+		Best:    map[string]*Server{"b": fast.Server},
+	})
+	if err != nil {
+		t.Fatalf("could not marshal data: %v", err)
+	}
+	maxBytes := uint(len(data["regions"]) + len(data["best"]))
+
+	fitted, dropped, err := fitConfigMapData(formatJSON, false, cmData, maxBytes)
+	if err != nil {
+		t.Fatalf("could not fit data: %v", err)
+	}
+	if dropped != 1 || len(fitted.Regions) != 1 || fitted.Regions[0] != fast {
+		t.Fatalf("got %d servers dropped, want only the slowest one", dropped)
+	}
+	if _, exists := fitted.Best["a"]; exists || fitted.Best["b"] != fast.Server {
+		t.Errorf("got best servers %v, want only the one of b", fitted.Best)
+	}
+
+	if _, _, err := fitConfigMapData(formatJSON, false, cmData, 10); err == nil {
+		t.Error("no error when not even a single server fits")
+	}
+}
+
+func TestGetServersListFromFile(t *testing.T) {
+	path, err := filepath.Abs(filepath.Join("testdata", "servers.json"))
+	if err != nil {
+		t.Fatalf("could not get fixture path: %v", err)
+	}
+	ctx := context.Background()
+
+	list, err := getServersList(ctx, http.DefaultClient, "file://"+path, "", "", nil)
+	if err != nil {
+		t.Fatalf("could not read servers list: %v", err)
+	}
+	if len(list.Regions) != 2 || list.Port(groupWireGuard, 0) != 1337 {
+		t.Errorf("got %d regions and port %d, want 2 and 1337", len(list.Regions), list.Port(groupWireGuard, 0))
+	}
+
+	for _, listURL := range []string{
+		"file://" + filepath.Join(filepath.Dir(path), "missing.json"),
+		"file://testdata/servers.json",
+	} {
+		_, err := getServersList(ctx, http.DefaultClient, listURL, "", "", nil)
+		var ferr *FetchError
+		if !errors.As(err, &ferr) {
+			t.Errorf("%s: got error %v, want a fetch error", listURL, err)
+		}
+	}
+}
+
+func TestDispatchMaxRegions(t *testing.T) {
+	const maxRegions = 2
+	regions := newTestRegions(6, 3)
+
+	reqChan := make(chan *ServerLatency)
+	var (
+		mu       sync.Mutex
+		received = map[string]int{}
+		probed   = map[string]int{}
+		inFlight int
+		maxSeen  int
+	)
+
+	// Regions are in flight from when their first server is received
+	// until all of them are probed.
+	wg := sync.WaitGroup{}
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for req := range reqChan {
+				id := req.Region.ID
+				mu.Lock()
+				if received[id] == 0 {
+					inFlight++
+					if inFlight > maxSeen {
+						maxSeen = inFlight
+					}
+				}
+				received[id]++
+				mu.Unlock()
+
+				time.Sleep(time.Millisecond)
+
+				mu.Lock()
+				probed[id]++
+				if probed[id] == len(req.Region.Servers.WireGuard) {
+					inFlight--
+				}
+				mu.Unlock()
+				req.done()
+			}
+		}()
+	}
+
+	count, err := dispatch(context.Background(), reqChan, regions, 1337, maxRegions, 1)
+	close(reqChan)
+	wg.Wait()
+	if err != nil {
+		t.Fatalf("could not dispatch: %v", err)
+	}
+	if count != 18 {
+		t.Errorf("got %d servers dispatched, want 18", count)
+	}
+	if maxSeen > maxRegions {
+		t.Errorf("got %d regions in flight, want at most %d", maxSeen, maxRegions)
+	}
+}
+
+func TestDispatchCanceledReleasesRegions(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	// Requests are queued but never probed, as if the workers had exited.
+	ctx, canc := context.WithCancel(context.Background())
+	reqChan := make(chan *ServerLatency, 100)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		dispatch(ctx, reqChan, newTestRegions(4, 2), 1337, 2, 1)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	canc()
+	<-done
+
+	for start := time.Now(); runtime.NumGoroutine() > before; {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("got %d goroutines left, want %d", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNewJitter(t *testing.T) {
+	first, second := newJitter(time.Minute, 42), newJitter(time.Minute, 42)
+	other := newJitter(time.Minute, 43)
+
+	same := true
+	for i := 0; i < 10; i++ {
+		delay := first()
+		if delay < 0 || delay >= time.Minute {
+			t.Fatalf("got delay %s, want it between 0 and 1m", delay)
+		}
+		if got := second(); got != delay {
+			t.Fatalf("got delay %s with the same seed, want %s", got, delay)
+		}
+		same = same && other() == delay
+	}
+	if same {
+		t.Error("got the same delays with another seed")
+	}
+
+	if delay := newJitter(0, 42)(); delay != 0 {
+		t.Errorf("got delay %s without jitter, want 0", delay)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	authv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// requiredVerbs returns the verbs needed on configmaps with the provided
+// options.
+func requiredVerbs(opts *Options) []string {
+	verbs := []string{"get", "create", "update"}
+	if strings.EqualFold(opts.UpdateStrategy, updateStrategyPatch) {
+		verbs = append(verbs, "patch")
+	}
+	if strings.EqualFold(opts.OutputMode, outputModeSplit) {
+		verbs = append(verbs, "list", "delete")
+	}
+	if opts.RecreateOnDelete {
+		verbs = append(verbs, "watch")
+	}
+
+	return verbs
+}
+
+// missingVerbs asks the API server which of verbs the process is not allowed
+// to use on configmaps in namespace.
+func missingVerbs(ctx context.Context, clientset kubernetes.Interface, namespace string, verbs []string) ([]string, error) {
+	missing := []string{}
+	for _, verb := range verbs {
+		review := &authv1.SelfSubjectAccessReview{
+			Spec: authv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authv1.ResourceAttributes{
+					Namespace: namespace,
+					Verb:      verb,
+					Resource:  "configmaps",
+				},
+			},
+		}
+
+		res, err := clientset.AuthorizationV1().SelfSubjectAccessReviews().
+			Create(ctx, review, metav1.CreateOptions{})
+		if err != nil {
+			return nil, err
+		}
+
+		if !res.Status.Allowed {
+			missing = append(missing, verb)
+		}
+	}
+
+	return missing, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/net/proxy"
+)
+
+// report fetches the servers list and probes all servers once, then writes
+// a table with the fastest server of each region to w. Kubernetes is not
+// involved at all.
+func report(ctx context.Context, w io.Writer, httpClient *http.Client, dialer proxy.ContextDialer, signatureKey *rsa.PublicKey, log zerolog.Logger, opts *Options) error {
+	list, err := getServersList(ctx, httpClient, opts.ServersListURL, opts.ServersListAuth, opts.UserAgent, signatureKey)
+	if err != nil {
+		return err
+	}
+
+	reqChan := make(chan *ServerLatency, opts.RequestBuffer)
+	resChan := make(chan *ServerLatency, opts.ResultBuffer)
+
+	wg := sync.WaitGroup{}
+	startWorkers(ctx, &wg, dialer, reqChan, resChan, log, opts)
+
+	go func() {
+		regions := filterVAN(filterRegions(list.Regions, opts.RegionIDs), opts.VAN)
+		port := list.Port(groupWireGuard, uint16(opts.ProbePort))
+		dispatch(ctx, reqChan, regions, port, opts.MaxConcurrentRegions, 0)
+
+		close(reqChan)
+		wg.Wait()
+		close(resChan)
+	}()
+
+	all := []*ServerLatency{}
+	for res := range resChan {
+		dropSlow(res, opts.MaxLatency)
+		all = append(all, res)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Only keep the fastest server of each region.
+	best := bestPerRegion(all)
+	results := make([]*ServerLatency, 0, len(best))
+	for _, res := range best {
+		results = append(results, res)
+	}
+	sortResults(results, opts.OrderBy, opts.OrderDirection)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "REGION\tID\tSERVER\tIP\tLATENCY")
+	for _, res := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+			res.Region.Name, res.Region.ID, res.CN, res.IP, res.Latency)
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+)
+
+// resultsStore holds the results of the last cycle that were written, so
+// that they can be served over HTTP.
+type resultsStore struct {
+	mu      sync.RWMutex
+	results []*ServerLatency
+}
+
+func (s *resultsStore) Set(results []*ServerLatency) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.results = results
+}
+
+func (s *resultsStore) Get() []*ServerLatency {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.results
+}
+
+// newServer returns a server listening on address that serves the results in
+// store at /regions, as YAML if the client accepts it or JSON otherwise.
+func newServer(address string, store *resultsStore, log zerolog.Logger) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/regions", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		results := store.Get()
+		if results == nil {
+			// Nothing has been written yet.
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		var (
+			data  []byte
+			err   error
+			ctype string
+		)
+		if strings.Contains(r.Header.Get("Accept"), "yaml") {
+			data, err = yaml.Marshal(results)
+			ctype = "application/yaml"
+		} else {
+			data, err = json.Marshal(results)
+			ctype = "application/json"
+		}
+		if err != nil {
+			log.Err(err).Msg("could not encode regions")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", ctype)
+		w.Write(data)
+	})
+
+	return &http.Server{Addr: address, Handler: mux}
+}
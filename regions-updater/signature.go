@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+)
+
+// splitServersList separates the JSON payload of the servers list from the
+// base64 signature that PIA appends to it after a newline.
+func splitServersList(body []byte) (payload, signature []byte) {
+	idx := bytes.IndexByte(body, '\n')
+	if idx < 0 {
+		return body, nil
+	}
+
+	return body[:idx], bytes.TrimSpace(body[idx+1:])
+}
+
+// verifySignature checks that signature is a valid base64 RSA SHA256
+// signature of payload, made with the private key paired to pubKey.
+func verifySignature(pubKey *rsa.PublicKey, payload, signature []byte) error {
+	if len(signature) == 0 {
+		return fmt.Errorf("no signature found")
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(string(signature))
+	if err != nil {
+		return fmt.Errorf("could not decode signature: %w", err)
+	}
+
+	hashed := sha256.Sum256(payload)
+	if err := rsa.VerifyPKCS1v15(pubKey, crypto.SHA256, hashed[:], sig); err != nil {
+		return fmt.Errorf("invalid signature: %w", err)
+	}
+
+	return nil
+}
+
+// loadPublicKey reads a PEM encoded RSA public key from path.
+func loadPublicKey(path string) (*rsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key is not an RSA key")
+	}
+
+	return rsaKey, nil
+}
@@ -1,5 +1,205 @@
 package main
 
+import "sort"
+
+// sortResults sorts results in place, by the provided order type and
+// direction.
+func sortResults(results []*ServerLatency, orderBy, orderDirection string) {
+	var sortIface sort.Interface
+	switch orderBy {
+	case orderByLatency:
+		if orderDirection == ascendingOrder {
+			sortIface = byLowerLatency(results)
+		} else {
+			sortIface = byGreaterLatency(results)
+		}
+	case orderByRegionName:
+		if orderDirection == ascendingOrder {
+			sortIface = byLowerRegionName(results)
+		} else {
+			sortIface = byGreaterRegionName(results)
+		}
+	}
+
+	sort.Sort(sortIface)
+}
+
+// splitDegraded returns the results with a latency, keeping their order,
+// and the degraded ones sorted by IP.
+func splitDegraded(results []*ServerLatency) (measured, degraded []*ServerLatency) {
+	measured = make([]*ServerLatency, 0, len(results))
+	for _, res := range results {
+		if res.Latency == nil {
+			degraded = append(degraded, res)
+			continue
+		}
+
+		measured = append(measured, res)
+	}
+
+	sort.Slice(degraded, func(i, j int) bool {
+		return degraded[i].IP < degraded[j].IP
+	})
+
+	return measured, degraded
+}
+
+// sortRegionServers sorts the WireGuard servers inside the region of each
+// result by the latency measured for them, in the provided direction, so
+// that the first one is the fastest when sorting in ascending order.
+// Servers that were not measured are always put last.
+func sortRegionServers(results []*ServerLatency, orderDirection string) {
+	latencies := map[string]Duration{}
+	for _, res := range results {
+		if res.Latency != nil {
+			latencies[res.IP] = *res.Latency
+		}
+	}
+
+	for _, res := range results {
+		if res.Region == nil || res.Region.Servers == nil {
+			continue
+		}
+
+		servers := res.Region.Servers.WireGuard
+		sort.SliceStable(servers, func(i, j int) bool {
+			ilat, iok := latencies[servers[i].IP]
+			jlat, jok := latencies[servers[j].IP]
+			if !iok || !jok {
+				return iok
+			}
+
+			if orderDirection == ascendingOrder {
+				return ilat < jlat
+			}
+
+			return ilat > jlat
+		})
+	}
+}
+
+// bestPerRegion returns the server with the lowest latency of each region,
+// keyed by region ID. Results without a latency are ignored.
+func bestPerRegion(results []*ServerLatency) map[string]*ServerLatency {
+	best := map[string]*ServerLatency{}
+	for _, res := range results {
+		if res.Latency == nil {
+			continue
+		}
+
+		if b, exists := best[res.Region.ID]; !exists || *res.Latency < *b.Latency {
+			best[res.Region.ID] = res
+		}
+	}
+
+	return best
+}
+
+// regionExtremes returns the best server of the fastest and of the slowest
+// region. Both are nil if no result has a latency.
+func regionExtremes(results []*ServerLatency) (fastest, slowest *ServerLatency) {
+	for _, res := range bestPerRegion(results) {
+		if fastest == nil || *res.Latency < *fastest.Latency {
+			fastest = res
+		}
+		if slowest == nil || *res.Latency > *slowest.Latency {
+			slowest = res
+		}
+	}
+
+	return fastest, slowest
+}
+
+// groupByCountry returns the regions of the already sorted results, keyed by
+// country. Each region only appears once, in the order it first appears in
+// the results.
+func groupByCountry(results []*ServerLatency) map[string][]*Region {
+	countries := map[string][]*Region{}
+	seen := map[string]bool{}
+	for _, res := range results {
+		if seen[res.Region.ID] {
+			continue
+		}
+
+		seen[res.Region.ID] = true
+		countries[res.Country] = append(countries[res.Country], res.Region)
+	}
+
+	return countries
+}
+
+// limitRegions returns the already sorted results keeping at most maxRegions
+// regions, in the order they first appear, and at most maxPerRegion servers
+// for each of them. A limit of 0 means no limit.
+func limitRegions(results []*ServerLatency, maxRegions, maxPerRegion uint) []*ServerLatency {
+	if maxRegions == 0 && maxPerRegion == 0 {
+		return results
+	}
+
+	limited := make([]*ServerLatency, 0, len(results))
+	perRegion := map[string]uint{}
+	for _, res := range results {
+		count, seen := perRegion[res.Region.ID]
+		if !seen && maxRegions > 0 && len(perRegion) == int(maxRegions) {
+			continue
+		}
+
+		if maxPerRegion > 0 && count == maxPerRegion {
+			continue
+		}
+
+		perRegion[res.Region.ID] = count + 1
+		limited = append(limited, res)
+	}
+
+	return limited
+}
+
+// truncateResults returns at most maxServers of the already sorted results,
+// keeping the order. The first minPerRegion servers of each region are kept
+// before any other, as long as maxServers allows it.
+func truncateResults(results []*ServerLatency, maxServers, minPerRegion uint) []*ServerLatency {
+	if maxServers == 0 || len(results) <= int(maxServers) {
+		return results
+	}
+
+	keep := make([]bool, len(results))
+	kept := 0
+
+	perRegion := map[string]uint{}
+	for i, res := range results {
+		if kept == int(maxServers) {
+			break
+		}
+
+		if perRegion[res.Region.ID] < minPerRegion {
+			keep[i] = true
+			perRegion[res.Region.ID]++
+			kept++
+		}
+	}
+
+	for i := range results {
+		if kept == int(maxServers) {
+			break
+		}
+
+		if !keep[i] {
+			keep[i] = true
+			kept++
+		}
+	}
+
+	truncated := make([]*ServerLatency, 0, kept)
+	for i, res := range results {
+		if keep[i] {
+			truncated = append(truncated, res)
+		}
+	}
+
+	return truncated
+}
+
 type byLowerLatency []*ServerLatency
 
 func (ll byLowerLatency) Len() int {
@@ -13,6 +213,10 @@ func (ll byLowerLatency) Less(i, j int) bool {
 		return false
 	}
 
+	if *iserv.Latency == *jserv.Latency {
+		return breakTie(iserv, jserv)
+	}
+
 	return *iserv.Latency < *jserv.Latency
 }
 
@@ -33,6 +237,10 @@ func (ll byGreaterLatency) Less(i, j int) bool {
 		return false
 	}
 
+	if *iserv.Latency == *jserv.Latency {
+		return breakTie(iserv, jserv)
+	}
+
 	return *iserv.Latency > *jserv.Latency
 }
 
@@ -54,6 +262,15 @@ func (rn byLowerRegionName) Less(i, j int) bool {
 	}
 
 	if iserv.Region.Name == jserv.Region.Name {
+		if iserv.Latency == nil || jserv.Latency == nil {
+			// Don't sort
+			return false
+		}
+
+		if *iserv.Latency == *jserv.Latency {
+			return breakTie(iserv, jserv)
+		}
+
 		return *iserv.Latency > *jserv.Latency
 	}
 
@@ -78,6 +295,15 @@ func (rn byGreaterRegionName) Less(i, j int) bool {
 	}
 
 	if iserv.Region.Name == jserv.Region.Name {
+		if iserv.Latency == nil || jserv.Latency == nil {
+			// Don't sort
+			return false
+		}
+
+		if *iserv.Latency == *jserv.Latency {
+			return breakTie(iserv, jserv)
+		}
+
 		return *iserv.Latency > *jserv.Latency
 	}
 
@@ -87,3 +313,14 @@ func (rn byGreaterRegionName) Less(i, j int) bool {
 func (rn byGreaterRegionName) Swap(i, j int) {
 	rn[i], rn[j] = rn[j], rn[i]
 }
+
+// breakTie is used between servers with the same latency: the one with the
+// lower jitter comes first and, if that is the same as well, the IP is used
+// so that the same servers are always sorted in the same way.
+func breakTie(iserv, jserv *ServerLatency) bool {
+	if iserv.Jitter != nil && jserv.Jitter != nil && *iserv.Jitter != *jserv.Jitter {
+		return *iserv.Jitter < *jserv.Jitter
+	}
+
+	return iserv.IP < jserv.IP
+}
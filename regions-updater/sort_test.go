@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestSortByRegionName(t *testing.T) {
+	newResults := func() []*ServerLatency {
+		results := []*ServerLatency{}
+		for _, s := range []struct {
+			region  string
+			ip      string
+			latency time.Duration
+		}{
+			{"Berlin", "10.0.0.1", 10 * time.Millisecond},
+			{"Zurich", "10.0.2.1", 5 * time.Millisecond},
+			{"Amsterdam", "10.0.1.1", 30 * time.Millisecond},
+			{"Berlin", "10.0.0.2", 20 * time.Millisecond},
+			{"Zurich", "10.0.2.2", 15 * time.Millisecond},
+			{"Amsterdam", "10.0.1.2", 40 * time.Millisecond},
+		} {
+			latency := Duration(s.latency)
+			results = append(results, &ServerLatency{
+				Latency: &latency,
+				Server:  &Server{IP: s.ip},
+				Region:  &Region{ID: s.region, Name: s.region},
+			})
+		}
+
+		return results
+	}
+
+	// Within a region, the slowest servers come first.
+	tests := []struct {
+		name string
+		sort func([]*ServerLatency) sort.Interface
+		want []string
+	}{
+		{
+			name: "ascending",
+			sort: func(results []*ServerLatency) sort.Interface { return byLowerRegionName(results) },
+			want: []string{"10.0.1.2", "10.0.1.1", "10.0.0.2", "10.0.0.1", "10.0.2.2", "10.0.2.1"},
+		},
+		{
+			name: "descending",
+			sort: func(results []*ServerLatency) sort.Interface { return byGreaterRegionName(results) },
+			want: []string{"10.0.2.2", "10.0.2.1", "10.0.0.2", "10.0.0.1", "10.0.1.2", "10.0.1.1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results := newResults()
+			sort.Sort(tt.sort(results))
+
+			for i, res := range results {
+				if res.IP != tt.want[i] {
+					t.Fatalf("got %s at position %d, want %s", res.IP, i, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+// newSortResults returns servers of several regions, some of them with the
+// same latency and jitter so that only their IP tells them apart.
+func newSortResults() []*ServerLatency {
+	results := []*ServerLatency{}
+	for _, s := range []struct {
+		region  string
+		ip      string
+		latency time.Duration
+	}{
+		{"Berlin", "10.0.0.3", 20 * time.Millisecond},
+		{"Berlin", "10.0.0.1", 20 * time.Millisecond},
+		{"Berlin", "10.0.0.2", 10 * time.Millisecond},
+		{"Amsterdam", "10.0.1.2", 30 * time.Millisecond},
+		{"Amsterdam", "10.0.1.1", 30 * time.Millisecond},
+		{"Zurich", "10.0.2.1", 10 * time.Millisecond},
+		{"Zurich", "10.0.2.2", 5 * time.Millisecond},
+	} {
+		res := newTestResult(0, s.region, s.ip, s.latency)
+		res.Region.Name = s.region
+		results = append(results, res)
+	}
+
+	return results
+}
+
+func TestSortResultsIsStable(t *testing.T) {
+	for _, orderBy := range []string{orderByLatency, orderByRegionName} {
+		for _, direction := range []string{ascendingOrder, descendingOrder} {
+			var outputs [][]byte
+			for run := int64(0); run < 2; run++ {
+				results := newSortResults()
+				rand.New(rand.NewSource(run)).Shuffle(len(results), func(i, j int) {
+					results[i], results[j] = results[j], results[i]
+				})
+
+				sortResults(results, orderBy, direction)
+				out, err := yaml.Marshal(results)
+				if err != nil {
+					t.Fatalf("could not marshal results: %v", err)
+				}
+				outputs = append(outputs, out)
+			}
+
+			if !bytes.Equal(outputs[0], outputs[1]) {
+				t.Errorf("%s %s: got different output for the same servers:\n%s\n---\n%s",
+					orderBy, direction, outputs[0], outputs[1])
+			}
+		}
+	}
+}
+
+func TestSortResultsByRegionName(t *testing.T) {
+	tests := []struct {
+		direction string
+		want      []string
+	}{
+		{
+			direction: ascendingOrder,
+			want:      []string{"10.0.1.1", "10.0.1.2", "10.0.0.1", "10.0.0.3", "10.0.0.2", "10.0.2.1", "10.0.2.2"},
+		},
+		{
+			direction: descendingOrder,
+			want:      []string{"10.0.2.1", "10.0.2.2", "10.0.0.1", "10.0.0.3", "10.0.0.2", "10.0.1.1", "10.0.1.2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.direction, func(t *testing.T) {
+			results := newSortResults()
+			sortResults(results, orderByRegionName, tt.direction)
+
+			// Within a region, the slowest servers come first, then
+			// servers with the same latency are sorted by IP.
+			for i, res := range results {
+				if res.IP != tt.want[i] {
+					t.Fatalf("got %s at position %d, want %s", res.IP, i, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSortByRegionNameNilLatency(t *testing.T) {
+	for _, direction := range []string{ascendingOrder, descendingOrder} {
+		t.Run(direction, func(t *testing.T) {
+			results := newSortResults()
+			for _, res := range results {
+				if res.Region.Name == "Berlin" {
+					res.Latency = nil
+				}
+			}
+
+			sortResults(results, orderByRegionName, direction)
+
+			// Servers of the same region must still be next to each other.
+			seen := map[string]bool{}
+			for i, res := range results {
+				if seen[res.Region.Name] && results[i-1].Region.Name != res.Region.Name {
+					t.Fatalf("servers of %s are not grouped", res.Region.Name)
+				}
+				seen[res.Region.Name] = true
+			}
+			if len(results) != len(newSortResults()) {
+				t.Fatalf("got %d results, want %d", len(results), len(newSortResults()))
+			}
+		})
+	}
+}
+
+func TestTruncateResultsMinPerRegion(t *testing.T) {
+	// Sorted by latency: region a is the fastest and would take all the
+	// room without the minimum per region.
+	results := []*ServerLatency{
+		newTestResult(0, "a", "10.0.0.1", 1*time.Millisecond),
+		newTestResult(0, "a", "10.0.0.2", 2*time.Millisecond),
+		newTestResult(0, "a", "10.0.0.3", 3*time.Millisecond),
+		newTestResult(0, "b", "10.0.1.1", 4*time.Millisecond),
+		newTestResult(0, "b", "10.0.1.2", 5*time.Millisecond),
+		newTestResult(0, "c", "10.0.2.1", 6*time.Millisecond),
+		newTestResult(0, "c", "10.0.2.2", 7*time.Millisecond),
+	}
+
+	tests := []struct {
+		name         string
+		maxServers   uint
+		minPerRegion uint
+		want         []string
+	}{
+		{name: "no minimum", maxServers: 3, minPerRegion: 0, want: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}},
+		{name: "one per region", maxServers: 4, minPerRegion: 1, want: []string{"10.0.0.1", "10.0.0.2", "10.0.1.1", "10.0.2.1"}},
+		// The cap is smaller than regions×min: the minimum is honored in
+		// order, so the slowest regions get fewer servers.
+		{name: "cap below regions times min", maxServers: 4, minPerRegion: 2, want: []string{"10.0.0.1", "10.0.0.2", "10.0.1.1", "10.0.1.2"}},
+		{name: "cap below regions", maxServers: 2, minPerRegion: 1, want: []string{"10.0.0.1", "10.0.1.1"}},
+		{name: "no cap", maxServers: 0, minPerRegion: 2, want: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.1.1", "10.0.1.2", "10.0.2.1", "10.0.2.2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := truncateResults(results, tt.maxServers, tt.minPerRegion)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d results, want %d", len(got), len(tt.want))
+			}
+			for i, res := range got {
+				if res.IP != tt.want[i] {
+					t.Errorf("got %s at position %d, want %s", res.IP, i, tt.want[i])
+				}
+			}
+		})
+	}
+}
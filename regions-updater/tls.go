@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// tlsHandshake performs a TLS handshake on conn for serverName, and returns
+// the TLS connection. The certificate of the server is verified with
+// rootCAs, or the ones of the system if nil. conn is closed if the
+// handshake fails.
+func tlsHandshake(ctx context.Context, conn net.Conn, serverName string, rootCAs *x509.CertPool, insecureSkipVerify bool) (net.Conn, error) {
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName:         serverName,
+		RootCAs:            rootCAs,
+		InsecureSkipVerify: insecureSkipVerify,
+	})
+
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
+// loadCertPool returns a pool with the PEM encoded certificates in the file
+// at path.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no valid certificates found in %s", path)
+	}
+
+	return pool, nil
+}
+
+// isCertificateError returns whether err is caused by a certificate that
+// could not be verified, e.g. because it is expired or for another name.
+func isCertificateError(err error) bool {
+	var (
+		invalidErr   x509.CertificateInvalidError
+		hostnameErr  x509.HostnameError
+		authorityErr x509.UnknownAuthorityError
+	)
+
+	return errors.As(err, &invalidErr) ||
+		errors.As(err, &hostnameErr) ||
+		errors.As(err, &authorityErr)
+}
@@ -1,8 +1,11 @@
 package main
 
-import "time"
+import (
+	"encoding/json"
+	"time"
 
-// TODO: groups
+	"gopkg.in/yaml.v3"
+)
 
 type Region struct {
 	ID          string       `json:"id" yaml:"id"`
@@ -14,6 +17,9 @@ type Region struct {
 	Geo         bool         `json:"geo" yaml:"geo"`
 	Offline     bool         `json:"offline" yaml:"offline"`
 	Servers     *ServersList `json:"servers" yaml:"servers"`
+	// Healthy tells whether the DNS name of the region could be resolved.
+	// It is nil if the DNS name was not checked.
+	Healthy *bool `json:"healthy,omitempty" yaml:"healthy,omitempty"`
 }
 
 func (r *Region) Clone() *Region {
@@ -29,6 +35,11 @@ func (r *Region) Clone() *Region {
 		Servers:     &ServersList{},
 	}
 
+	if r.Healthy != nil {
+		healthy := *r.Healthy
+		reg.Healthy = &healthy
+	}
+
 	// We use wireguard, so for now we don't copy others.
 	reg.Servers.WireGuard = []*Server{}
 	for _, w := range r.Servers.WireGuard {
@@ -50,23 +61,120 @@ type Server struct {
 	IP  string `json:"ip" yaml:"ip"`
 	CN  string `json:"cn" yaml:"cn"`
 	VAN bool   `json:"van" yaml:"van,omitempty"`
+	// LastProbed is the time the latency of this server was last measured.
+	LastProbed time.Time `json:"last_probed" yaml:"lastProbed,omitempty"`
+	// Jitter is the spread of the latency samples taken for this server,
+	// only available when more than one sample is taken.
+	Jitter *Duration `json:"jitter,omitempty" yaml:"jitter,omitempty"`
+	// Degraded is true if the server could not be probed or was too slow.
+	Degraded bool `json:"degraded,omitempty" yaml:"degraded,omitempty"`
 }
 
 func (s *Server) Clone() *Server {
 	return &Server{
-		IP:  s.IP,
-		CN:  s.CN,
-		VAN: s.VAN,
+		IP:         s.IP,
+		CN:         s.CN,
+		VAN:        s.VAN,
+		LastProbed: s.LastProbed,
+		Jitter:     s.Jitter.Clone(),
+		Degraded:   s.Degraded,
 	}
 }
 
 type ServersListResponse struct {
-	// Groups
-	Regions []*Region `json:"regions" yaml:"regions"`
+	// Groups maps the name of each protocol, e.g. "wg", to the ports its
+	// servers listen on.
+	Groups  map[string][]*Group `json:"groups" yaml:"groups"`
+	Regions []*Region           `json:"regions" yaml:"regions"`
 }
 
+// Port returns the first port listed for group, or def if there is none.
+func (l *ServersListResponse) Port(group string, def uint16) uint16 {
+	for _, g := range l.Groups[group] {
+		if len(g.Ports) > 0 {
+			return g.Ports[0]
+		}
+	}
+
+	return def
+}
+
+type Group struct {
+	Name  string   `json:"name" yaml:"name"`
+	Ports []uint16 `json:"ports" yaml:"ports"`
+}
+
+// ServerLatency is a server paired with the region it belongs to and its
+// measured latency. This is what workers produce and what gets sorted and
+// written to the configmap.
 type ServerLatency struct {
-	Latency *time.Duration `json:"latency" yaml:"latency"`
+	Latency *Duration `json:"latency" yaml:"latency"`
 	*Server
 	*Region
+
+	// port is the port the server is probed on, it is not written.
+	port uint16
+	// done, if not nil, is called once the server has been probed.
+	done func()
+	// cycle is the number of the update cycle the server was dispatched in.
+	cycle uint64
+}
+
+// Duration is a time.Duration that is marshalled as a human-readable string,
+// i.e. "23ms", instead of a number of nanoseconds. Use a *Duration to allow
+// the value to be absent, as it is in the servers list returned by PIA.
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// Clone returns a copy of d, or nil if d is nil.
+func (d *Duration) Clone() *Duration {
+	if d == nil {
+		return nil
+	}
+
+	dur := *d
+	return &dur
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+
+	var val string
+	if err := json.Unmarshal(data, &val); err != nil {
+		return err
+	}
+
+	return d.parse(val)
+}
+
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	var val string
+	if err := value.Decode(&val); err != nil {
+		return err
+	}
+
+	return d.parse(val)
+}
+
+func (d *Duration) parse(val string) error {
+	dur, err := time.ParseDuration(val)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(dur)
+	return nil
 }